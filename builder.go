@@ -1,12 +1,19 @@
 package build
 
 import (
+	"encoding/json"
+	"fmt"
+	"go/build/constraint"
+	"io"
 	"io/fs"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
 	"github.com/Masterminds/semver/v3"
@@ -16,8 +23,10 @@ import (
 )
 
 type Builder struct {
-	Code        CodeInfo
-	Git         GitInfo
+	Code CodeInfo
+	Git  GitInfo
+	// Filled by NewBuilder, with the archs already expanded. The default targets are created from it by NewBuilder,
+	// so later changes don't affect them.
 	Executables []ExecutableInfo
 
 	Targets       Targets
@@ -25,36 +34,93 @@ type Builder struct {
 
 	Console *Console
 
+	// Where progress and reports are written. Use SetOutput to change them, so the Console is updated too.
+	Out io.Writer
+	Err io.Writer
+
 	GO         string
 	GO_VERSION *semver.Version
 	GO_GOOS    string
 	GO_GOARCH  string
 
 	GIT string
+
+	// Only set if the tinygo compiler is configured
+	TINYGO string
+
+	cfg       *BuilderConfig
+	artifacts []Artifact
+	// Environment variables from BuilderConfig.EnvFile
+	buildEnv []string
+	// Build targets of best effort archs that failed
+	failedBuilds map[string]bool
+	// Result of validateExecutable by executable path and arch
+	validatedExecutables map[string]error
+	// Archs already warned about building with cgo without a C cross compiler
+	cgoWarnedArchs map[string]bool
+	// Locks of the target serialization groups, by group
+	groupLocks map[string]*sync.Mutex
+	// Executables to remove at the end of the run, by CleanBinariesAfterZip
+	zippedBinaries []string
+	// Guards artifacts, failedBuilds, validatedExecutables, cgoWarnedArchs, groupLocks and zippedBinaries, that
+	// targets change
+	mutex sync.Mutex
+	// LLVM toolchain folder inside BuilderConfig.AndroidNDK
+	androidToolchain string
+	// Code.Version was created from BuilderConfig.DevelVersionTemplate
+	develVersion bool
 }
 
 type CodeInfo struct {
-	BaseDir   string
+	BaseDir string
+	// Module path of BaseDir. Empty when BaseDir has a go.work file that does not use BaseDir itself as a module.
 	Package   string
 	Version   *semver.Version
 	BuildDate time.Time
 	License   string
 
 	MinGoVersion *semver.Version
+
+	// The modules in the go.work file, or only the module in BaseDir if there is no go.work
+	Modules   []ModuleInfo
+	Workspace bool
+}
+
+type ModuleInfo struct {
+	Path string
+	Dir  string
 }
 
 type ExecutableInfo struct {
 	Name    string
 	Path    string
 	Package string
+	// Folder of the module, relative to BaseDir. Only filled when using a go.work file.
+	Module string
 
 	Archs       []string
 	GCO         bool
 	BuildArgs   []string
 	LDFlags     []string
 	LDFlagsVars map[string]string
+	// Profile passed to go build -pgo. If there is a default.pgo file in Path it is used by default.
+	PGOProfile string
+	// PGOProfile is the default.pgo found in Path, so it is ignored without warnings where PGO is not supported
+	pgoDetected bool
+	// Template for the executable file name. See BuilderConfig.BinaryNameTemplate.
+	BinaryNameTemplate string
+	// See BuilderConfig.SplitDebug
+	SplitDebug bool
 
 	Publish bool
+
+	// Name of the BuilderConfig.Variants entry this executable was created from, or empty
+	Variant string
+
+	// Args used to run the executable in the smoke test. nil means no smoke test.
+	SmokeArgs []string
+
+	Metadata Metadata
 }
 
 type GitInfo struct {
@@ -77,15 +143,107 @@ func NewBuilder(cfg *BuilderConfig) (*Builder, error) {
 		}
 	}
 
-	b := &Builder{}
+	cfg.BaseDir, err = validateBaseDir(cfg.BaseDir, cfg.FindModuleRoot)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.Color {
+	case "", "auto", "always", "never":
+	default:
+		return nil, errors.Errorf("invalid color option: %v", cfg.Color)
+	}
+
+	if cfg.BinaryNameTemplate != "" {
+		_, err = template.New("binary").Parse(cfg.BinaryNameTemplate)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid binary name template")
+		}
+	}
+
+	if cfg.DevelVersionTemplate != "" {
+		_, err = template.New("develVersion").Parse(cfg.DevelVersionTemplate)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid devel version template")
+		}
+	}
+
+	if cfg.ArchDirFormat != "" {
+		_, err = template.New("archDir").Parse(cfg.ArchDirFormat)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid arch dir format")
+		}
+	}
+
+	switch cfg.ModMode {
+	case "", "mod", "vendor", "readonly":
+	default:
+		return nil, errors.Errorf("invalid mod mode: %v", cfg.ModMode)
+	}
+
+	switch cfg.BuildVCS {
+	case "", "true", "false", "auto":
+	default:
+		return nil, errors.Errorf("invalid build vcs option: %v", cfg.BuildVCS)
+	}
+
+	switch cfg.Compiler {
+	case "", "go", "tinygo":
+	default:
+		return nil, errors.Errorf("invalid compiler: %v", cfg.Compiler)
+	}
+
+	for arch := range cfg.MicroArchs {
+		_, goarch := splitArch(arch)
+		if goarch == "" {
+			goarch = arch
+		}
+
+		if microArchEnvVars[goarch] == "" {
+			return nil, errors.Errorf("arch without microarchitecture levels: %v", arch)
+		}
+	}
+
+	switch cfg.ImageMode {
+	case "", "daemonless", "docker":
+	default:
+		return nil, errors.Errorf("invalid image mode: %v", cfg.ImageMode)
+	}
+
+	switch cfg.ArchiveFormat {
+	case "", "zip", "tar.zst":
+	default:
+		return nil, errors.Errorf("invalid archive format: %v", cfg.ArchiveFormat)
+	}
+
+	if cfg.ZstdLevel < 0 || cfg.ZstdLevel > 22 {
+		return nil, errors.Errorf("invalid zstd level: %v", cfg.ZstdLevel)
+	}
+
+	if cfg.CompressionLevel < CompressionStore || cfg.CompressionLevel > CompressionBest {
+		return nil, errors.Errorf("invalid compression level: %v", cfg.CompressionLevel)
+	}
+
+	b := &Builder{
+		cfg: cfg,
+	}
 	b.Targets.items = map[string]*Target{}
+	b.failedBuilds = map[string]bool{}
+	b.validatedExecutables = map[string]error{}
+	b.cgoWarnedArchs = map[string]bool{}
+	b.groupLocks = map[string]*sync.Mutex{}
 
 	b.Console, err = CreateConsole(cfg.BaseDir)
 	if err != nil {
 		return nil, err
 	}
 
-	b.GO, err = b.Console.FindExecutable("go")
+	b.SetOutput(os.Stdout, os.Stderr)
+
+	b.Console.Secrets = append(b.Console.Secrets, cfg.WindowsSign.CertPassword, cfg.MacSign.Password,
+		os.Getenv("APPLE_PASSWORD"))
+
+	b.GO, err = b.findConfiguredExecutable(cfg.GoBinary, "go")
 	if err != nil {
 		return nil, err
 	}
@@ -95,29 +253,173 @@ func NewBuilder(cfg *BuilderConfig) (*Builder, error) {
 		return nil, err
 	}
 
-	b.GIT, _ = b.Console.FindExecutable("git")
+	if cfg.Compiler == "tinygo" {
+		b.TINYGO, err = b.Console.FindExecutable("tinygo")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.AndroidNDK != "" {
+		b.androidToolchain, err = b.findAndroidToolchain(cfg.BaseDir, cfg.AndroidNDK)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.GitBinary != "" {
+		b.GIT, err = b.findConfiguredExecutable(cfg.GitBinary, "git")
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = b.Console.RunAndReturnOutput(b.GIT, "--version")
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid git binary: %v", cfg.GitBinary)
+		}
+	} else {
+		b.GIT, _ = b.Console.FindExecutable("git")
+	}
+
+	// Only used to explain why a devel version was used
+	var gitTagErr error
 
 	if b.GIT != "" {
-		b.Git.Tag = b.findGitTag()
+		b.Git.Tag, gitTagErr = b.findGitTag()
 		b.Git.Commit = b.findGitCommit()
 		b.Git.CommitDate = b.findGitCommitDate()
+	} else {
+		gitTagErr = errors.New("git executable not found")
 	}
 
-	err = b.initCodeInfo(cfg)
+	err = b.initCodeInfo(cfg, gitTagErr)
 	if err != nil {
 		return nil, err
 	}
 
+	if cfg.ModulePath != "" && b.Code.Package == "" {
+		return nil, errors.Errorf("expected module %v in %v, but go.work does not use it as a module",
+			cfg.ModulePath, b.Code.BaseDir)
+	}
+	if cfg.ModulePath != "" && cfg.ModulePath != b.Code.Package {
+		return nil, errors.Errorf("expected module %v in %v, found %v", cfg.ModulePath, b.Code.BaseDir, b.Code.Package)
+	}
+
 	err = b.createExecutables(cfg)
 	if err != nil {
 		return nil, err
 	}
 
-	b.createDefaultTargets()
+	if !cfg.NoDefaultTargets {
+		err = b.createDefaultTargets()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = b.createCustomTargets(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.DefaultTarget != "" {
+		if b.Targets.Get(cfg.DefaultTarget) == nil {
+			return nil, errors.Errorf("unknown default target: %v", cfg.DefaultTarget)
+		}
+
+		b.DefaultTarget = cfg.DefaultTarget
+	}
 
 	return b, nil
 }
 
+// NewBuilderWithProfile creates a builder using cfg with the profile name applied over it.
+func NewBuilderWithProfile(cfg *BuilderConfig, name string) (*Builder, error) {
+	if cfg == nil {
+		cfg = NewBuilderConfig()
+	}
+
+	cfg, err := cfg.WithProfile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBuilder(cfg)
+}
+
+func (b *Builder) SetOutput(out io.Writer, err io.Writer) {
+	b.Out = out
+	b.Err = err
+	b.Console.Out = out
+	b.Console.Err = err
+}
+
+// validateBaseDir returns the absolute path of the base dir, resolved against the current dir, checking that it is a
+// folder with a go.mod or go.work file. With findRoot, its parents are searched for them too.
+func validateBaseDir(dir string, findRoot bool) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid base dir")
+	}
+	if !stat.IsDir() {
+		return "", errors.Errorf("invalid base dir: %v is not a folder", dir)
+	}
+
+	for current := dir; ; {
+		for _, name := range []string{"go.mod", "go.work"} {
+			_, err = os.Stat(filepath.Join(current, name))
+			if err == nil {
+				return current, nil
+			}
+		}
+
+		parent := filepath.Dir(current)
+		if !findRoot || parent == current {
+			break
+		}
+		current = parent
+	}
+
+	return "", errors.Errorf("invalid base dir: no go.mod or go.work found in %v. This should be run from the project "+
+		"folder.", dir)
+}
+
+// findAndroidToolchain returns the folder of the prebuilt LLVM toolchain of the NDK for this host
+func (b *Builder) findAndroidToolchain(baseDir string, ndk string) (string, error) {
+	if !filepath.IsAbs(ndk) {
+		ndk = filepath.Join(baseDir, ndk)
+	}
+
+	// The NDK only has x86_64 toolchains, that also run on arm64 macs
+	result := filepath.Join(ndk, "toolchains", "llvm", "prebuilt", b.GO_GOOS+"-x86_64")
+
+	_, err := os.Stat(filepath.Join(result, "bin"))
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid Android NDK %v: toolchain for %v not found", ndk, b.GO_GOOS)
+	}
+
+	return result, nil
+}
+
+// findConfiguredExecutable returns the configured executable, if not empty, or searches for it in PATH
+func (b *Builder) findConfiguredExecutable(configured string, name string) (string, error) {
+	if configured == "" {
+		return b.Console.FindExecutable(name)
+	}
+
+	result, err := exec.LookPath(configured)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid %v binary", name)
+	}
+
+	return filepath.Abs(result)
+}
+
 func (b *Builder) findGoVersion() (*semver.Version, string, string, error) {
 	goVersion, err := b.Console.RunAndReturnOutput(b.GO, "version")
 	if err != nil {
@@ -141,18 +443,38 @@ func (b *Builder) findGoVersion() (*semver.Version, string, string, error) {
 	return version, goos, goarch, nil
 }
 
-func (b *Builder) findGitTag() *semver.Version {
-	tag, err := b.Console.RunAndReturnOutput(b.GIT, "describe", "--tags", "--dirty")
+func (b *Builder) findGitTag() (*semver.Version, error) {
+	tag, err := b.Console.RunAndReturnOutput(b.gitDescribe("--dirty")...)
 	if err != nil {
-		return nil
+		return nil, errors.New("no git tag found")
 	}
 
-	ver, err := semver.NewVersion(tag)
+	ver, err := semver.NewVersion(strings.TrimPrefix(tag, b.cfg.TagPrefix))
 	if err != nil {
-		return nil
+		return nil, errors.Errorf("git tag is not a valid version: %v", tag)
 	}
 
-	return ver
+	return ver, nil
+}
+
+// gitDescribe returns the git describe command line, only matching tags with BuilderConfig.TagPrefix
+func (b *Builder) gitDescribe(args ...interface{}) []interface{} {
+	cmd := []interface{}{b.GIT, "describe", "--tags"}
+
+	if b.cfg.TagPrefix != "" {
+		cmd = append(cmd, "--match", b.cfg.TagPrefix+"*")
+	}
+
+	return append(cmd, args...)
+}
+
+// gitTagName returns the name of the git tag of a version
+func (b *Builder) gitTagName(ver *semver.Version) string {
+	if b.cfg.TagPrefix != "" {
+		return b.cfg.TagPrefix + ver.String()
+	}
+
+	return "v" + ver.String()
 }
 
 func (b *Builder) findGitCommit() string {
@@ -174,27 +496,44 @@ func (b *Builder) findGitCommitDate() *time.Time {
 	return &result
 }
 
-func (b *Builder) initCodeInfo(cfg *BuilderConfig) error {
+func (b *Builder) initCodeInfo(cfg *BuilderConfig, gitTagErr error) error {
 	var err error
 
 	b.Code.BaseDir = cfg.BaseDir
 
-	modFile := filepath.Join(b.Code.BaseDir, "go.mod")
-	modContent, err := os.ReadFile(modFile)
-	if err != nil {
-		return errors.Wrapf(err, "Error loading go.mod. This should be run from the project folder.")
-	}
+	_, err = os.Stat(filepath.Join(b.Code.BaseDir, "go.work"))
+	b.Code.Workspace = err == nil
 
-	ast, err := modfile.ParseLax(modFile, modContent, nil)
-	if err != nil {
-		return err
-	}
+	if b.Code.Workspace {
+		err = b.loadWorkspace(cfg)
+		if err != nil {
+			return err
+		}
 
-	b.Code.Package = ast.Module.Mod.Path
+	} else {
+		ast, err := parseModFile(b.Code.BaseDir)
+		if err != nil {
+			return err
+		}
 
-	b.Code.MinGoVersion, err = semver.NewVersion(ast.Go.Version)
-	if err != nil {
-		return err
+		b.Code.Package = ast.Module.Mod.Path
+
+		switch {
+		case ast.Go != nil:
+			b.Code.MinGoVersion, err = semver.NewVersion(ast.Go.Version)
+		case cfg.MinGoVersion != "":
+			b.Code.MinGoVersion, err = semver.NewVersion(cfg.MinGoVersion)
+		default:
+			b.Code.MinGoVersion = b.GO_VERSION
+		}
+		if err != nil {
+			return err
+		}
+
+		b.Code.Modules = []ModuleInfo{{
+			Path: b.Code.Package,
+			Dir:  b.Code.BaseDir,
+		}}
 	}
 
 	if b.Git.CommitDate != nil {
@@ -203,164 +542,719 @@ func (b *Builder) initCodeInfo(cfg *BuilderConfig) error {
 		b.Code.BuildDate = time.Now()
 	}
 
-	if b.Git.Tag != nil {
-		b.Code.Version = b.Git.Tag
-	} else {
-		ver := "0.0.0-devel+"
-		if b.Git.Commit != "" {
-			ver += b.Git.Commit[:7] + "."
-		}
-		ver += b.Code.BuildDate.Format("20060102150405")
-
-		b.Code.Version, err = semver.NewVersion(ver)
+	var fileVersion *semver.Version
+	if cfg.VersionFile != "" {
+		fileVersion, err = b.readVersionFile(cfg.VersionFile)
 		if err != nil {
 			return err
 		}
 	}
 
-	if cfg.License != "" {
-		b.Code.License = cfg.License
+	switch {
+	case cfg.Version != "":
+		b.Code.Version, err = semver.NewVersion(cfg.Version)
+		if err != nil {
+			return errors.Wrapf(err, "invalid version: %v", cfg.Version)
+		}
 
-	} else {
-		licenseFileNames, err := b.findLicenseFiles(b.Code.BaseDir)
+	case fileVersion != nil:
+		b.Code.Version = fileVersion
+
+	case b.Git.Tag != nil:
+		b.Code.Version = b.Git.Tag
+
+	default:
+		b.Code.Version, err = b.createDevelVersion(cfg.DevelVersionTemplate)
 		if err != nil {
 			return err
 		}
+		b.develVersion = true
 
-		if len(licenseFileNames) != 1 {
-			return errors.New("only one license supported")
+		if gitTagErr != nil {
+			fmt.Fprintf(b.Err, "WARNING: Using devel version %v: %v\n", b.Code.Version, gitTagErr)
 		}
+	}
+
+	if cfg.License != "" {
+		b.Code.License = cfg.License
 
-		data, err := os.ReadFile(licenseFileNames[0])
+	} else {
+		license, err := b.ProjectLicense()
 		if err != nil {
 			return err
 		}
 
-		cov := licensecheck.Scan(data)
-		if cov.Percent >= 75 { // Same as pkg.go.dev
-			b.Code.License = cov.Match[0].ID
-		}
+		b.Code.License = license.Name
 	}
 
 	return nil
 }
 
-func (b *Builder) createExecutables(cfg *BuilderConfig) error {
-	archs, err := b.ListArchs(cfg.Archs...)
+// ProjectLicense scans the license file in BaseDir. Name is empty if the license was not identified.
+func (b *Builder) ProjectLicense() (LicenseInfo, error) {
+	licenseFileNames, err := b.findLicenseFiles(b.Code.BaseDir)
 	if err != nil {
-		return err
+		return LicenseInfo{}, err
 	}
 
-	var ldflags []string
-	if !cfg.PreserveSymbols {
-		ldflags = append(ldflags, "-s", "-w")
+	if len(licenseFileNames) != 1 {
+		return LicenseInfo{}, errors.New("only one license supported")
 	}
 
-	ldflagsVars := map[string]string{}
-	for k, v := range cfg.LDFlagsVars {
-		ldflagsVars[k] = v
+	data, err := os.ReadFile(licenseFileNames[0])
+	if err != nil {
+		return LicenseInfo{}, err
 	}
-	ldflagsVars["main.version"] = b.Code.Version.String()
-	ldflagsVars["main.buildDate"] = b.Code.BuildDate.String()
-	ldflagsVars["main.commit"] = b.Git.Commit
 
-	err = b.findRelativeDirsWithMain(cfg, b.Code.BaseDir, func(path, rel string, publish bool) error {
-		var name string
-		if rel == "." {
-			name = filepath.Base(b.Code.Package)
-		} else {
-			name = filepath.Base(rel)
-		}
+	result := LicenseInfo{
+		Name:     b.classifyLicense(b.Code.Package, data),
+		Contents: string(data),
+	}
 
-		pkg := b.Code.Package
-		if rel != "." {
-			pkg += "/" + filepath.ToSlash(rel)
-		}
+	return result, nil
+}
 
-		e := ExecutableInfo{
-			Name:        name,
-			Path:        path,
-			Package:     pkg,
-			Archs:       archs,
-			GCO:         cfg.GCO,
-			BuildArgs:   cfg.BuildArgs,
-			LDFlags:     ldflags,
-			LDFlagsVars: ldflagsVars,
-			Publish:     publish,
+// classifyLicense returns the SPDX ID of a license file of a module, or "" if it was not identified
+func (b *Builder) classifyLicense(module string, data []byte) string {
+	if b.cfg.LicenseClassifier != nil {
+		name := b.cfg.LicenseClassifier(module, data)
+		if name != "" {
+			return name
 		}
+	}
 
-		b.Executables = append(b.Executables, e)
-
-		return nil
-	})
-	if err != nil {
-		return err
+	cov := licensecheck.Scan(data)
+	if cov.Percent >= 75 { // Same as pkg.go.dev
+		return cov.Match[0].ID
 	}
 
-	return nil
+	return ""
 }
 
-func (b *Builder) ListArchs(desired ...string) ([]string, error) {
-	available, err := b.listAvailableArchs()
+// readEnvFile returns the KEY=VALUE entries of a .env file, or nil if the file does not exist
+func (b *Builder) readEnvFile(name string) ([]string, error) {
+	if name == "" {
+		return nil, nil
+	}
+
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(b.Code.BaseDir, path)
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	var result []string
 
-	if len(desired) > 0 {
-		for _, a := range desired {
-			l, ok := available[a]
-			if !ok {
-				return nil, errors.Errorf("OS/ARCH not available: '%v'", a)
-			}
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
 
-			result = append(result, l...)
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		eq := strings.Index(line, "=")
+		if eq <= 0 {
+			return nil, errors.Errorf("invalid line in %v:%v: %v", name, i+1, line)
 		}
-	} else {
-		for k := range available {
-			if strings.Index(k, "/") > 0 {
-				result = append(result, k)
+
+		key := strings.TrimSpace(line[:eq])
+		value := strings.TrimSpace(line[eq+1:])
+
+		switch {
+		case len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"':
+			value = strings.NewReplacer(`\n`, "\n", `\"`, `"`, `\\`, `\`).Replace(value[1 : len(value)-1])
+		case len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'':
+			value = value[1 : len(value)-1]
+		default:
+			// Comments after unquoted values
+			if c := strings.Index(value, " #"); c >= 0 {
+				value = strings.TrimSpace(value[:c])
 			}
 		}
-	}
 
-	sort.Slice(result, func(i, j int) bool {
-		return result[i] < result[j]
-	})
+		result = append(result, key+"="+value)
+	}
 
 	return result, nil
 }
 
-func (b *Builder) findRelativeDirsWithMain(cfg *BuilderConfig, baseDir string, cb func(string, string, bool) error) error {
-	ignoredDirs := map[string]int{
-		"_examples": 0,
-		"examples":  0,
-		"internal":  0,
+// readVersionFile returns nil if the file does not exist or does not have a valid version
+func (b *Builder) readVersionFile(name string) (*semver.Version, error) {
+	path := name
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(b.Code.BaseDir, path)
 	}
 
-	mainFiles := map[string]int{}
-	for _, e := range cfg.MainFileNames {
-		mainFiles[e] = 1
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return filepath.WalkDir(baseDir,
-		func(path string, dir fs.DirEntry, err error) error {
-			if err != nil {
-				return nil
-			}
+	text := strings.TrimSpace(string(data))
+	text = strings.TrimPrefix(text, "v")
 
-			if dir.IsDir() {
-				if strings.HasPrefix(dir.Name(), ".") {
-					return filepath.SkipDir
-				}
+	result, err := semver.NewVersion(text)
+	if err != nil {
+		fmt.Fprintf(b.Err, "WARNING: Ignoring invalid version in %v: %v\n", name, text)
+		return nil, nil
+	}
 
-				return nil
-			}
+	return result, nil
+}
 
-			_, hasMain := mainFiles[dir.Name()]
-			if !hasMain {
-				return nil
+func (b *Builder) loadWorkspace(cfg *BuilderConfig) error {
+	output, err := b.Console.RunAndReturnOutput(b.GO, "work", "edit", "-json", filepath.Join(b.Code.BaseDir, "go.work"))
+	if err != nil {
+		return errors.Wrapf(err, "error loading go.work")
+	}
+
+	var work struct {
+		Go  string
+		Use []struct {
+			DiskPath string
+		}
+	}
+	err = json.Unmarshal([]byte(output), &work)
+	if err != nil {
+		return errors.Wrapf(err, "error loading go.work")
+	}
+
+	switch {
+	case work.Go != "":
+		b.Code.MinGoVersion, err = semver.NewVersion(work.Go)
+	case cfg.MinGoVersion != "":
+		b.Code.MinGoVersion, err = semver.NewVersion(cfg.MinGoVersion)
+	default:
+		b.Code.MinGoVersion = b.GO_VERSION
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, use := range work.Use {
+		dir := use.DiskPath
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(b.Code.BaseDir, dir)
+		}
+
+		modFile := filepath.Join(dir, "go.mod")
+		modContent, err := os.ReadFile(modFile)
+		if err != nil {
+			return errors.Wrapf(err, "error loading module used in go.work")
+		}
+
+		path := modfile.ModulePath(modContent)
+		if path == "" {
+			return errors.Errorf("module path not found in %v", modFile)
+		}
+
+		if dir == b.Code.BaseDir {
+			b.Code.Package = path
+		}
+
+		b.Code.Modules = append(b.Code.Modules, ModuleInfo{
+			Path: path,
+			Dir:  dir,
+		})
+	}
+
+	return nil
+}
+
+// parseModFile parses the go.mod file inside dir
+func parseModFile(dir string) (*modfile.File, error) {
+	modFile := filepath.Join(dir, "go.mod")
+	modContent, err := os.ReadFile(modFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Error loading go.mod. This should be run from the project folder.")
+	}
+
+	return modfile.ParseLax(modFile, modContent, nil)
+}
+
+func (b *Builder) createExecutables(cfg *BuilderConfig) error {
+	archs, err := b.ListArchs(cfg.Archs...)
+	if err != nil {
+		return err
+	}
+
+	var ldflags []string
+	if !cfg.PreserveSymbols || cfg.StripSymbolTable {
+		ldflags = append(ldflags, "-s")
+	}
+	if !cfg.PreserveSymbols || cfg.StripDWARF {
+		ldflags = append(ldflags, "-w")
+	}
+	ldflags = append(ldflags, cfg.LDFlags...)
+
+	envFile, err := b.readEnvFile(cfg.EnvFile)
+	if err != nil {
+		return err
+	}
+
+	ldflagsVars := map[string]string{}
+	for _, e := range envFile {
+		k, v := splitEnv(e)
+		if strings.Contains(k, ".") {
+			ldflagsVars[k] = v
+		} else {
+			b.buildEnv = append(b.buildEnv, e)
+		}
+	}
+	for k, v := range cfg.LDFlagsVars {
+		ldflagsVars[k] = v
+	}
+	ldflagsVars["main.version"] = b.Code.Version.String()
+	ldflagsVars["main.buildDate"] = b.Code.BuildDate.String()
+	ldflagsVars["main.commit"] = b.Git.Commit
+
+	metadata := cfg.Metadata
+	if metadata.License == "" {
+		metadata.License = b.Code.License
+	}
+
+	for _, mod := range b.Code.Modules {
+		module := ""
+		if b.Code.Workspace {
+			module, err = filepath.Rel(b.Code.BaseDir, mod.Dir)
+			if err != nil {
+				return err
+			}
+			module = filepath.ToSlash(module)
+		}
+
+		err = b.findRelativeDirsWithMain(cfg, mod.Dir, func(path, rel string, publish bool) error {
+			var name string
+			if rel == "." {
+				name = filepath.Base(mod.Path)
+			} else {
+				name = filepath.Base(rel)
+			}
+
+			pkg := mod.Path
+			if rel != "." {
+				pkg += "/" + filepath.ToSlash(rel)
+			}
+
+			pgo := ""
+			_, err := os.Stat(filepath.Join(path, "default.pgo"))
+			if err == nil {
+				pgo = filepath.Join(path, "default.pgo")
+			}
+
+			e := ExecutableInfo{
+				Name:        name,
+				Path:        path,
+				Package:     pkg,
+				Module:      module,
+				Archs:       archs,
+				GCO:         cfg.GCO,
+				BuildArgs:   cfg.BuildArgs,
+				LDFlags:     ldflags,
+				LDFlagsVars: ldflagsVars,
+				PGOProfile:  pgo,
+				pgoDetected: pgo != "",
+				Publish:     publish,
+
+				BinaryNameTemplate: cfg.BinaryNameTemplate,
+				SplitDebug:         cfg.SplitDebug,
+				Metadata:           metadata,
+			}
+
+			b.Executables = append(b.Executables, e)
+
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	err = b.fixDuplicatedExecutableNames()
+	if err != nil {
+		return err
+	}
+
+	err = b.addExecutableVariants(cfg)
+	if err != nil {
+		return err
+	}
+
+	for name := range cfg.SmokeTests {
+		if b.ExecutableByName(name) == nil {
+			return errors.Errorf("unknown executable in smoke tests: %v", name)
+		}
+	}
+
+	for name := range cfg.PGOProfiles {
+		if b.ExecutableByName(name) == nil {
+			return errors.Errorf("unknown executable in PGO profiles: %v", name)
+		}
+	}
+
+	for i := range b.Executables {
+		e := &b.Executables[i]
+
+		pgo, ok := cfg.PGOProfiles[e.Name]
+		if !ok {
+			pgo, ok = cfg.PGOProfiles[e.TargetName()]
+		}
+		if ok {
+			if pgo != "" && !filepath.IsAbs(pgo) {
+				pgo = filepath.Join(b.Code.BaseDir, pgo)
+			}
+
+			e.PGOProfile = pgo
+			e.pgoDetected = false
+		}
+
+		args, ok := cfg.SmokeTests[e.Name]
+		if !ok {
+			args, ok = cfg.SmokeTests[e.TargetName()]
+		}
+		if ok && args == nil {
+			args = []string{}
+		}
+
+		e.SmokeArgs = args
+	}
+
+	return b.applyPublishLists(cfg)
+}
+
+// applyPublishLists overrides the publish flag found from the folder names with BuilderConfig.Publish and NoPublish.
+// Variants use the lists of their executable, unless they are listed by their own name.
+func (b *Builder) applyPublishLists(cfg *BuilderConfig) error {
+	for _, names := range [][]string{cfg.Publish, cfg.NoPublish} {
+		for _, name := range names {
+			if b.ExecutableByName(name) == nil {
+				return errors.Errorf("unknown executable in publish list: %v", name)
+			}
+		}
+	}
+
+	matches := func(names []string, e ExecutableInfo) bool {
+		return containsString(names, e.Name) || containsString(names, e.TargetName())
+	}
+
+	for _, own := range []bool{false, true} {
+		for i := range b.Executables {
+			e := &b.Executables[i]
+
+			t := *e
+			if !own {
+				if e.Variant == "" {
+					continue
+				}
+				t.Name = strings.TrimSuffix(e.Name, "-"+e.Variant)
+			}
+
+			if matches(cfg.Publish, t) {
+				e.Publish = true
+			}
+			if matches(cfg.NoPublish, t) {
+				e.Publish = false
+			}
+		}
+	}
+
+	return nil
+}
+
+// addExecutableVariants adds a copy of the executables for each variant in BuilderConfig.Variants, named
+// <name>-<variant>
+func (b *Builder) addExecutableVariants(cfg *BuilderConfig) error {
+	names := map[string]bool{}
+	for _, e := range b.Executables {
+		names[e.Name] = true
+	}
+
+	var variants []ExecutableInfo
+	for _, v := range cfg.Variants {
+		if v.Name == "" {
+			return errors.New("variants must have a name")
+		}
+
+		for _, e := range b.Executables {
+			if len(v.Executables) > 0 && !containsString(v.Executables, e.Name) {
+				continue
+			}
+
+			e.Name += "-" + v.Name
+			e.Variant = v.Name
+
+			if names[e.Name] {
+				return errors.Errorf("variant %v of %v has the same name as another executable: %v",
+					v.Name, e.Path, e.Name)
+			}
+			names[e.Name] = true
+
+			e.BuildArgs = append(append([]string{}, e.BuildArgs...), v.BuildArgs...)
+			if len(v.Tags) > 0 {
+				e.BuildArgs = append(e.BuildArgs, "-tags", strings.Join(v.Tags, ","))
+			}
+
+			e.LDFlags = append(append([]string{}, e.LDFlags...), v.LDFlags...)
+
+			ldflagsVars := map[string]string{}
+			for k, val := range e.LDFlagsVars {
+				ldflagsVars[k] = val
+			}
+			for k, val := range v.LDFlagsVars {
+				ldflagsVars[k] = val
+			}
+			e.LDFlagsVars = ldflagsVars
+
+			variants = append(variants, e)
+		}
+	}
+
+	b.Executables = append(b.Executables, variants...)
+
+	return nil
+}
+
+// fixDuplicatedExecutableNames renames executables with the same name to use their path, so cmd/foo and tools/foo
+// become cmd-foo and tools-foo. Otherwise they would overwrite each other in the output folder.
+func (b *Builder) fixDuplicatedExecutableNames() error {
+	count := map[string]int{}
+	for _, e := range b.Executables {
+		count[e.Name]++
+	}
+
+	for i := range b.Executables {
+		e := &b.Executables[i]
+		if count[e.Name] < 2 {
+			continue
+		}
+
+		rel, err := filepath.Rel(b.Code.BaseDir, e.Path)
+		if err != nil {
+			return err
+		}
+
+		if rel != "." {
+			e.Name = strings.ReplaceAll(filepath.ToSlash(rel), "/", "-")
+		}
+	}
+
+	paths := map[string]string{}
+	for _, e := range b.Executables {
+		other, ok := paths[e.Name]
+		if ok {
+			return errors.Errorf("executables in %v and %v have the same name: %v", other, e.Path, e.Name)
+		}
+
+		paths[e.Name] = e.Path
+	}
+
+	return nil
+}
+
+// TargetName is the name used in the targets of this executable. When using a go.work file, it is prefixed with the
+// module folder.
+func (e ExecutableInfo) TargetName() string {
+	if e.Module == "" || e.Module == "." {
+		return e.Name
+	}
+
+	return e.Module + "/" + e.Name
+}
+
+// PublishedExecutables returns the executables that are zipped.
+func (b *Builder) PublishedExecutables() []ExecutableInfo {
+	var result []ExecutableInfo
+	for _, e := range b.Executables {
+		if e.Publish {
+			result = append(result, e)
+		}
+	}
+
+	return result
+}
+
+// ExecutableByName returns the executable with the name or target name, or nil if there is none.
+func (b *Builder) ExecutableByName(name string) *ExecutableInfo {
+	for i := range b.Executables {
+		e := &b.Executables[i]
+		if e.Name == name || e.TargetName() == name {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// Names used by other tools (uname, docker, rust, ...) for go OS and ARCH values
+var osAliases = map[string]string{
+	"macos": "darwin",
+	"osx":   "darwin",
+	"win":   "windows",
+}
+
+var archAliases = map[string]string{
+	"x86_64":  "amd64",
+	"x64":     "amd64",
+	"aarch64": "arm64",
+	"armv8":   "arm64",
+	"x86":     "386",
+	"i386":    "386",
+	"i686":    "386",
+	"armv6":   "arm",
+	"armv7":   "arm",
+	"armhf":   "arm",
+	"ppc64el": "ppc64le",
+}
+
+// normalizeArch replaces the aliases in an os/arch or os value by the names used by go
+func normalizeArch(a string) string {
+	goos, goarch := a, ""
+	if i := strings.Index(a, "/"); i >= 0 {
+		goos, goarch = a[:i], a[i+1:]
+	}
+
+	if n, ok := osAliases[strings.ToLower(goos)]; ok {
+		goos = n
+	}
+	if n, ok := archAliases[strings.ToLower(goarch)]; ok {
+		goarch = n
+	}
+
+	if goarch == "" {
+		return goos
+	}
+
+	return goos + "/" + goarch
+}
+
+func (b *Builder) ListArchs(desired ...string) ([]string, error) {
+	available, err := b.listAvailableArchs()
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+
+	desired = resolveTargetPlatform(desired)
+
+	if len(desired) > 0 {
+		for _, a := range desired {
+			if a == "host" {
+				a = b.GO_GOOS + "/" + b.GO_GOARCH
+			}
+
+			a = normalizeArch(a)
+
+			l, ok := available[a]
+			if !ok {
+				return nil, errors.Errorf("OS/ARCH not available: '%v'", a)
+			}
+
+			result = append(result, l...)
+		}
+	} else {
+		for k := range available {
+			if strings.Index(k, "/") > 0 {
+				result = append(result, k)
+			}
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i] < result[j]
+	})
+
+	return result, nil
+}
+
+// resolveTargetPlatform replaces $TARGETPLATFORM with the arch from the docker buildx environment variables. If they
+// are not set, it is removed, and if no other arch remains the default archs are used.
+func resolveTargetPlatform(archs []string) []string {
+	if !containsString(archs, "$TARGETPLATFORM") {
+		return archs
+	}
+
+	platform := os.Getenv("TARGETPLATFORM")
+	if platform == "" && os.Getenv("TARGETOS") != "" && os.Getenv("TARGETARCH") != "" {
+		platform = os.Getenv("TARGETOS") + "/" + os.Getenv("TARGETARCH")
+	}
+
+	// Ignore the variant, as in linux/arm/v7
+	parts := strings.Split(platform, "/")
+	if len(parts) > 2 {
+		platform = parts[0] + "/" + parts[1]
+	}
+
+	var result []string
+	for _, a := range archs {
+		switch {
+		case a != "$TARGETPLATFORM":
+			result = append(result, a)
+		case platform != "":
+			result = append(result, platform)
+		}
+	}
+
+	if len(result) == 0 {
+		result = NewBuilderConfig().Archs
+	}
+
+	return result
+}
+
+func (b *Builder) findRelativeDirsWithMain(cfg *BuilderConfig, baseDir string, cb func(string, string, bool) error) error {
+	ignoredDirs := map[string]int{
+		"_examples": 0,
+		"examples":  0,
+		"internal":  0,
+	}
+
+	mainFiles := map[string]int{}
+	for _, e := range cfg.MainFileNames {
+		mainFiles[e] = 1
+	}
+
+	return filepath.WalkDir(baseDir,
+		func(path string, dir fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+
+			if dir.IsDir() {
+				if strings.HasPrefix(dir.Name(), ".") {
+					return filepath.SkipDir
+				}
+
+				// Nested modules can't be built from this one
+				if path != baseDir {
+					_, err = os.Stat(filepath.Join(path, "go.mod"))
+					if err == nil {
+						return filepath.SkipDir
+					}
+				}
+
+				return nil
+			}
+
+			_, hasMain := mainFiles[dir.Name()]
+			if !hasMain {
+				return nil
+			}
+
+			// Usually generator scripts, run with go run
+			if hasIgnoreBuildConstraint(path) {
+				return nil
 			}
 
 			abs := filepath.Dir(path)
@@ -389,13 +1283,52 @@ func (b *Builder) findRelativeDirsWithMain(cfg *BuilderConfig, baseDir string, c
 		})
 }
 
+// hasIgnoreBuildConstraint returns true if the file has a build constraint that needs the ignore tag
+func hasIgnoreBuildConstraint(path string) bool {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+
+		if strings.HasPrefix(line, "package ") {
+			break
+		}
+
+		if !constraint.IsGoBuild(line) && !constraint.IsPlusBuild(line) {
+			continue
+		}
+
+		expr, err := constraint.Parse(line)
+		if err != nil {
+			continue
+		}
+
+		withoutIgnore := expr.Eval(func(tag string) bool { return tag != "ignore" })
+		withIgnore := expr.Eval(func(tag string) bool { return true })
+		if !withoutIgnore && withIgnore {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (b *Builder) listAvailableArchs() (map[string][]string, error) {
-	list, err := b.Console.RunAndReturnOutput(b.GO, "tool", "dist", "list")
+	list, err := b.loadDistList()
 	if err != nil {
 		return nil, err
 	}
 
-	arr := strings.Split(list, "\n")
+	return parseDistList(list), nil
+}
+
+// parseDistList returns the archs of the go tool dist list output, by os and by arch
+func parseDistList(list string) map[string][]string {
+	// Fields also handles \r\n on windows
+	arr := strings.Fields(list)
 
 	result := map[string][]string{}
 
@@ -408,58 +1341,574 @@ func (b *Builder) listAvailableArchs() (map[string][]string, error) {
 	}
 
 	for _, a := range arr {
-		goos := strings.Split(a, "/")[0]
+		goos, _ := splitArch(a)
 		add(goos, a)
 		add(a, a)
 	}
 
-	return result, nil
+	return result
+}
+
+// loadDistList returns the output of go tool dist list, cached in the user cache dir by go version
+func (b *Builder) loadDistList() (string, error) {
+	cacheFile := ""
+	if cacheDir, err := os.UserCacheDir(); err == nil {
+		cacheFile = filepath.Join(cacheDir, "pescuma-go-build",
+			fmt.Sprintf("dist-list-%v-%v_%v.txt", b.GO_VERSION, b.GO_GOOS, b.GO_GOARCH))
+	}
+
+	if cacheFile != "" && !b.cfg.RefreshDistListCache {
+		data, err := os.ReadFile(cacheFile)
+		if err == nil && len(data) > 0 {
+			return string(data), nil
+		}
+	}
+
+	list, err := b.Console.RunAndReturnOutput(b.GO, "tool", "dist", "list")
+	if err != nil {
+		return "", err
+	}
+
+	if cacheFile != "" {
+		// The cache is only an optimization, so failing to write it is not an error
+		if err := os.MkdirAll(filepath.Dir(cacheFile), 0o755); err == nil {
+			_ = writeFileAtomic(cacheFile, []byte(list))
+		}
+	}
+
+	return list, nil
 }
 
-func (b *Builder) createDefaultTargets() {
-	b.Targets.Add("license-check", nil, func() error {
+func (b *Builder) createDefaultTargets() error {
+	lt := b.Targets.Add("license-check", nil, func() error {
 		return b.RunLicenseCheck()
 	})
+	lt.describe = b.describeText("check the licenses of the dependencies against the code license")
+
+	generateCmd := b.goCommand("generate", "./...")
+	gt := b.Targets.Add("generate", nil, func() error {
+		return b.Console.RunInline(generateCmd...)
+	})
+	gt.describe = b.describeCommand(generateCmd...)
+
+	fmtCmd := b.goCommand("fmt", "./...")
+	ft := b.Targets.Add("fmt", nil, func() error {
+		return b.Console.RunInline(fmtCmd...)
+	})
+	ft.describe = b.describeCommand(fmtCmd...)
+
+	fct := b.Targets.Add("fmt-check", nil, func() error {
+		return b.RunFmtCheck()
+	})
+	fct.describe = b.describeText("check that gofmt does not change any go file")
+
+	b.Targets.Add("check", []string{"fmt-check"}, nil)
+
+	gct := b.Targets.Add("generate-changed", nil, func() error {
+		return b.RunGenerateChanged()
+	})
+	gct.describe = b.describeText("run go generate in the packages changed since the last run")
+
+	testCmd := b.testCommand("./...")
+	tt := b.Targets.Add("test", nil, func() error {
+		return b.Console.RunInline(testCmd...)
+	})
+	tt.describe = b.describeCommand(testCmd...)
+
+	cvt := b.Targets.Add("coverage", nil, func() error {
+		return b.RunCoverage()
+	})
+	cvt.describe = b.describeText("run the tests with coverage and check the minimum coverage")
 
-	b.Targets.Add("generate", nil, func() error {
-		return b.Console.RunInline(b.GO, "generate", "./...")
+	bct := b.Targets.Add("bench", nil, func() error {
+		return b.RunBench()
 	})
+	bct.describe = b.describeText("run the benchmarks")
 
-	b.Targets.Add("test", nil, func() error {
-		return b.Console.RunInline(b.GO, "test", "./...")
+	vt := b.Targets.Add("version", nil, func() error {
+		return b.PrintVersion(false)
 	})
+	vt.describe = b.describeText("print the version")
 
-	b.Targets.Add("clean-zip", nil, func() error {
+	drt := b.Targets.Add("doctor", nil, func() error {
+		return b.RunDoctor()
+	})
+	drt.describe = b.describeText("check the build environment")
+
+	cit := b.Targets.Add("cache-info", nil, func() error {
+		return b.RunGoCacheInfo()
+	})
+	cit.describe = b.describeText("print the go build cache folder and size")
+
+	tgt := b.Targets.Add("tag", nil, func() error {
+		return b.RunTag()
+	})
+	tgt.describe = b.describeText("create the git tag of the version")
+
+	clt := b.Targets.Add("changelog", nil, func() error {
+		return b.RunChangelog()
+	})
+	clt.describe = b.describeText("write the changelog since the previous tag")
+
+	czt := b.Targets.Add("clean-zip", nil, func() error {
 		return b.RunCleanZip()
 	})
+	czt.describe = b.describeText("remove the zips of the current version")
 
 	bt := b.Targets.Add("build", nil, nil)
-	zt := b.Targets.Add("zip", []string{"clean-zip"}, nil)
+	bat := b.Targets.Add("build-all", nil, nil)
+	bpt := b.Targets.Add("build-publish", nil, nil)
+	zt := b.Targets.Add("zip", nil, nil)
+
+	depsCmd := []interface{}{b.GO, "mod", "download"}
+	dt := b.Targets.Add("deps", nil, func() error {
+		return b.Console.RunInline(depsCmd...)
+	})
+	dt.describe = b.describeCommand(depsCmd...)
+
+	var buildDeps []string
+	if b.cfg.DownloadDepsBeforeBuild {
+		buildDeps = append(buildDeps, dt.Name)
+	}
+
+	if b.cfg.GenerateBuildInfo {
+		bit := b.Targets.Add("build-info", nil, func() error {
+			return b.RunGenerateBuildInfo()
+		})
+		bit.describe = b.describeText("generate buildinfo_gen.go")
+
+		buildDeps = append(buildDeps, "build-info")
+	}
+
+	if len(b.cfg.AssetBuilds) > 0 {
+		at := b.Targets.Add("assets", nil, nil)
+
+		for _, ab := range b.cfg.AssetBuilds {
+			if ab.Name == "" || len(ab.Run) == 0 || ab.Output == "" {
+				return errors.Errorf("asset build needs name, command and output: %v", ab.Name)
+			}
+
+			if b.Targets.Get(at.Name+":"+ab.Name) != nil {
+				return errors.Errorf("duplicated asset build name: %v", ab.Name)
+			}
+
+			args := make([]interface{}, len(ab.Run))
+			for i, a := range ab.Run {
+				args[i] = a
+			}
+
+			aa := ab
+			aat := b.Targets.Add(at.Name+":"+ab.Name, nil, func() error {
+				return b.RunAssetBuild(aa)
+			})
+			aat.describe = b.describeCommand(args...)
+			at.AddDependency(aat)
+		}
+
+		buildDeps = append(buildDeps, at.Name)
+	}
+
+	hostArch := b.GO_GOOS + "/" + b.GO_GOARCH
 
 	for _, exec := range b.Executables {
-		bet := b.Targets.Add(bt.Name+":"+exec.Name, nil, nil)
-		bt.AddDependency(bet)
+		bet := b.Targets.Add(bt.Name+":"+exec.TargetName(), nil, nil)
+		baet := b.Targets.Add(bat.Name+":"+exec.TargetName(), nil, nil)
+
+		if exec.Publish {
+			bpt.AddDependency(bet)
+		}
+
+		if exec.Publish || !b.cfg.BuildPublishedOnly {
+			bt.AddDependency(bet)
+			bat.AddDependency(baet)
+		}
+
+		// Executables that are not published are not zipped, so they have no sign or zip targets
+		var zet *Target
+		if exec.Publish {
+			zet = b.Targets.Add(zt.Name+":"+exec.TargetName(), nil, nil)
+			zt.AddDependency(zet)
+		}
 
-		zet := b.Targets.Add(zt.Name+":"+exec.Name, nil, nil)
-		zt.AddDependency(zet)
+		// If the host can't be built, build always builds everything
+		buildAll := b.cfg.BuildAllArchs || !containsString(exec.Archs, hostArch)
 
 		for _, arch := range exec.Archs {
 			ee := exec
 			aa := arch
 
-			beat := b.Targets.Add(bet.Name+":"+arch, nil, func() error {
-				return b.RunBuild(ee, aa)
+			beatName := bet.Name + ":" + arch
+
+			beat := b.Targets.Add(beatName, buildDeps, func() error {
+				err := b.RunBuild(ee, aa)
+				if err != nil && b.isBestEffortArch(aa) {
+					fmt.Fprintf(b.Err, "WARNING: Ignoring build error of best effort arch %v: %v\n", aa, err)
+					b.setBuildFailed(beatName)
+					return nil
+				}
+
+				return err
 			})
-			bet.AddDependency(beat)
+			beat.describe = func() (string, error) {
+				cmd, err := b.createBuildCommand(ee, aa, io.Discard)
+				if err != nil {
+					return "", err
+				}
+
+				return b.Console.FormatCommand(cmd...), nil
+			}
+			baet.AddDependency(beat)
+
+			if buildAll || arch == hostArch {
+				bet.AddDependency(beat)
+			}
+
+			if zet == nil {
+				continue
+			}
+
+			zipDep := beat.Name
+
+			if b.cfg.WindowsSign.CertFile != "" && strings.HasPrefix(arch, "windows/") {
+				seat := b.Targets.Add("sign:"+exec.TargetName()+":"+arch, []string{beat.Name}, func() error {
+					if b.buildFailed(beatName) {
+						return nil
+					}
+
+					return b.RunCodeSign(ee, aa)
+				})
+				seat.describe = b.describeText("sign the executable with authenticode")
+				zipDep = seat.Name
+			}
+
+			if b.cfg.MacSign.Identity != "" && strings.HasPrefix(arch, "darwin/") {
+				seat := b.Targets.Add("sign:"+exec.TargetName()+":"+arch, []string{beat.Name}, func() error {
+					if b.buildFailed(beatName) {
+						return nil
+					}
+
+					return b.RunMacSign(ee, aa)
+				})
+				seat.describe = b.describeText("sign the executable with codesign")
+				zipDep = seat.Name
+			}
+
+			zipDeps := []string{zipDep}
+
+			// Smoke test the executable before zipping it, so a broken executable is not zipped
+			if exec.SmokeArgs != nil && arch == hostArch {
+				zipDeps = append(zipDeps, "smoke:"+exec.TargetName())
+			}
+
+			zeat := b.Targets.Add(zet.Name+":"+arch, zipDeps, func() error {
+				if b.buildFailed(beatName) {
+					fmt.Fprintf(b.Out, "Skipping zip: build of %v failed\n", aa)
+					return nil
+				}
 
-			zeat := b.Targets.Add(zet.Name+":"+arch, []string{beat.Name}, func() error {
 				return b.RunZip(ee, aa)
 			})
+			zeat.describe = func() (string, error) {
+				output, err := b.GetOutputZipName(ee, aa)
+				if err != nil {
+					return "", err
+				}
+
+				return "create " + output, nil
+			}
 			zet.AddDependency(zeat)
 		}
 	}
 
-	b.Targets.Add("all", []string{"license-check", "build", "test", "zip"}, nil)
+	if len(b.cfg.Images) > 0 {
+		err := b.createImageTargets()
+		if err != nil {
+			return err
+		}
+	}
+
+	st := b.Targets.Add("smoke", nil, nil)
+	for _, exec := range b.Executables {
+		if exec.SmokeArgs == nil || !containsString(exec.Archs, hostArch) {
+			continue
+		}
+
+		ee := exec
+		set := b.Targets.Add(st.Name+":"+exec.TargetName(), []string{"build:" + exec.TargetName() + ":" + hostArch},
+			func() error {
+				return b.RunSmokeTest(ee)
+			})
+		set.describe = func() (string, error) {
+			output, err := b.GetOutputExecutableName(ee, hostArch)
+			if err != nil {
+				return "", err
+			}
+
+			args := []interface{}{output}
+			for _, a := range ee.SmokeArgs {
+				args = append(args, a)
+			}
+
+			return b.Console.FormatCommand(args...), nil
+		}
+		st.AddDependency(set)
+	}
+
+	var allDeps []string
+	if b.cfg.BuildAllArchs {
+		allDeps = []string{"license-check", "build", "test", "zip"}
+	} else {
+		allDeps = []string{"license-check", "build", "test"}
+	}
+
+	releaseDeps := []string{"license-check", "build-all", "test", "zip"}
+
+	if len(st.Dependencies) > 0 {
+		allDeps = append(allDeps, st.Name)
+		releaseDeps = append(releaseDeps, st.Name)
+	}
+
+	b.Targets.Add("all", allDeps, nil)
+	b.Targets.Add("release", releaseDeps, nil)
+
+	btt := b.Targets.Add("build-tests", nil, nil)
+
+	if len(b.cfg.TestBinaries.Packages) > 0 {
+		testArchs := b.cfg.TestBinaries.Archs
+		if len(testArchs) == 0 {
+			testArchs = []string{"host"}
+		}
+
+		archs, err := b.ListArchs(testArchs...)
+		if err != nil {
+			return err
+		}
+
+		for _, pkg := range b.cfg.TestBinaries.Packages {
+			for _, arch := range archs {
+				pp := pkg
+				aa := arch
+
+				btpat := b.Targets.Add(btt.Name+":"+pkg+":"+arch, nil, func() error {
+					return b.RunBuildTest(pp, aa)
+				})
+				btpat.describe = func() (string, error) {
+					output, err := b.GetOutputTestBinaryName(pp, aa)
+					if err != nil {
+						return "", err
+					}
+
+					return "compile the test binary " + output, nil
+				}
+				btt.AddDependency(btpat)
+			}
+		}
+	}
 
 	b.DefaultTarget = "all"
+
+	return nil
+}
+
+func (b *Builder) createImageTargets() error {
+	it := b.Targets.Add("image", nil, nil)
+	ipt := b.Targets.Add("image-push", nil, nil)
+
+	for _, img := range b.cfg.Images {
+		exec := b.ExecutableByName(img.Executable)
+		if exec == nil {
+			return errors.Errorf("unknown executable in image: %v", img.Executable)
+		}
+
+		var archs []string
+		var deps []string
+		for _, arch := range exec.Archs {
+			if strings.HasPrefix(arch, "linux/") {
+				archs = append(archs, arch)
+				deps = append(deps, "build:"+exec.TargetName()+":"+arch)
+			}
+		}
+
+		if len(archs) == 0 {
+			return errors.Errorf("image of %v needs linux in Archs", exec.Name)
+		}
+
+		ii := img
+		ee := *exec
+
+		iet := b.Targets.Add(it.Name+":"+exec.TargetName(), deps, func() error {
+			var built []string
+			for _, arch := range archs {
+				if !b.buildFailed("build:" + ee.TargetName() + ":" + arch) {
+					built = append(built, arch)
+				}
+			}
+
+			return b.RunImage(ii, ee, built)
+		})
+		iet.describe = func() (string, error) {
+			output, err := b.GetOutputImageName(ee)
+			if err != nil {
+				return "", err
+			}
+
+			return "create the OCI image " + output, nil
+		}
+		it.AddDependency(iet)
+
+		ipet := b.Targets.Add(ipt.Name+":"+exec.TargetName(), []string{iet.Name}, func() error {
+			return b.RunImagePush(ii, ee)
+		})
+		ipet.describe = b.describeText("push the image to " + ii.Repository)
+		ipt.AddDependency(ipet)
+
+		if b.cfg.ImageMode == "docker" {
+			iet.InGroup("docker")
+			ipet.InGroup("docker")
+		}
+	}
+
+	return nil
+}
+
+func (b *Builder) isBestEffortArch(arch string) bool {
+	goos, _ := splitArch(arch)
+
+	return containsString(b.cfg.BestEffortArchs, arch) || containsString(b.cfg.BestEffortArchs, goos)
+}
+
+func (b *Builder) createCustomTargets(cfg *BuilderConfig) error {
+	for _, ct := range cfg.CustomTargets {
+		if ct.Name == "" {
+			return errors.New("custom target without name")
+		}
+
+		if b.Targets.Get(ct.Name) != nil {
+			return errors.Errorf("custom target conflicts with existing target: %v", ct.Name)
+		}
+
+		if len(ct.Run) == 0 {
+			return errors.Errorf("custom target without command to run: %v", ct.Name)
+		}
+
+		args := make([]interface{}, len(ct.Run))
+		for i, a := range ct.Run {
+			args[i] = a
+		}
+
+		outputs := ct.Artifacts
+
+		t := b.Targets.Add(ct.Name, ct.Dependencies, func() error {
+			err := b.Console.RunInline(args...)
+			if err != nil {
+				return err
+			}
+
+			for _, o := range outputs {
+				err = b.RegisterArtifact(o, "custom")
+				if err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+		t.describe = b.describeCommand(args...)
+	}
+
+	for _, ct := range cfg.CustomTargets {
+		for _, dep := range ct.Dependencies {
+			if b.Targets.Get(dep) == nil {
+				return errors.Errorf("unknown dependency of custom target %v: %v", ct.Name, dep)
+			}
+		}
+	}
+
+	return nil
+}
+
+// NextVersion returns the version after the current git tag (or Code.Version if there is no tag), incrementing part:
+// major, minor or patch. If there is no version yet, it returns 0.1.0.
+func (b *Builder) NextVersion(part string) (*semver.Version, error) {
+	current := b.Git.Tag
+	if current == nil && !b.IsDevelVersion() {
+		current = b.Code.Version
+	}
+
+	if current == nil {
+		return semver.NewVersion("0.1.0")
+	}
+
+	// Remove the suffixes from git describe (as in 1.2.3-4-gabcdef-dirty)
+	base, err := semver.NewVersion(fmt.Sprintf("%v.%v.%v", current.Major(), current.Minor(), current.Patch()))
+	if err != nil {
+		return nil, err
+	}
+
+	var result semver.Version
+	switch part {
+	case "major":
+		result = base.IncMajor()
+	case "minor":
+		result = base.IncMinor()
+	case "patch":
+		result = base.IncPatch()
+	default:
+		return nil, errors.Errorf("unknown version part: %v (should be major, minor or patch)", part)
+	}
+
+	return &result, nil
+}
+
+// IsDevelVersion returns true if Code.Version was created because no version was found.
+func (b *Builder) IsDevelVersion() bool {
+	return b.Code.Version == nil || b.develVersion || b.Code.Version.Prerelease() == "devel"
+}
+
+// createDevelVersion executes the devel version template, with the fields .Commit, .ShortCommit and .Date. Empty
+// means the default 0.0.0-devel+<commit>.<date> format.
+func (b *Builder) createDevelVersion(text string) (*semver.Version, error) {
+	if text == "" {
+		text = "0.0.0-devel+{{with .ShortCommit}}{{.}}.{{end}}{{.Date}}"
+	}
+
+	tmpl, err := template.New("develVersion").Parse(text)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid devel version template")
+	}
+
+	shortCommit := b.Git.Commit
+	if len(shortCommit) > 7 {
+		shortCommit = shortCommit[:7]
+	}
+
+	var ver strings.Builder
+	err = tmpl.Execute(&ver, map[string]string{
+		"Commit":      b.Git.Commit,
+		"ShortCommit": shortCommit,
+		"Date":        b.Code.BuildDate.Format("20060102150405"),
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "error executing devel version template")
+	}
+
+	result, err := semver.NewVersion(ver.String())
+	if err != nil {
+		return nil, errors.Wrapf(err, "devel version template created an invalid version: %v", ver.String())
+	}
+
+	return result, nil
+}
+
+// describeText returns a description of a target that runs go code instead of a command
+func (b *Builder) describeText(text string) func() (string, error) {
+	return func() (string, error) {
+		return text, nil
+	}
+}
+
+func (b *Builder) describeCommand(args ...interface{}) func() (string, error) {
+	return func() (string, error) {
+		return b.Console.FormatCommand(args...), nil
+	}
 }
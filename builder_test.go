@@ -0,0 +1,146 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestNewBuilderWithWorkspaceWithoutGoDirective(t *testing.T) {
+	b := newTestBuilder(t, map[string]string{
+		"go.work":           "use ./a\n",
+		"a/go.mod":          "module example.com/a\n\ngo 1.17\n",
+		"a/cmd/foo/main.go": "package main\n\nfunc main() {}\n",
+	}, nil)
+
+	if !b.Code.MinGoVersion.Equal(b.GO_VERSION) {
+		t.Errorf("expected min go version %v, got %v", b.GO_VERSION, b.Code.MinGoVersion)
+	}
+	if b.Code.Package != "" {
+		t.Errorf("expected no package, got %v", b.Code.Package)
+	}
+	if len(b.Code.Modules) != 1 || b.Code.Modules[0].Path != "example.com/a" {
+		t.Errorf("unexpected modules: %v", b.Code.Modules)
+	}
+}
+
+func TestNewBuilderWithModulePathNotUsedByWorkspace(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.BaseDir = t.TempDir()
+	cfg.License = "MIT"
+	cfg.ModulePath = "example.com/a"
+
+	writeTestFiles(t, cfg.BaseDir, map[string]string{
+		"go.work":  "go 1.17\n\nuse ./a\n",
+		"a/go.mod": "module example.com/a\n\ngo 1.17\n",
+	})
+
+	_, err := NewBuilder(cfg)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestNewBuilderWithGoModWithoutGoDirective(t *testing.T) {
+	b := newTestBuilder(t, map[string]string{
+		"go.mod":  "module example.com/example\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	}, nil)
+
+	if !b.Code.MinGoVersion.Equal(b.GO_VERSION) {
+		t.Errorf("expected min go version %v, got %v", b.GO_VERSION, b.Code.MinGoVersion)
+	}
+}
+
+func TestNewBuilderWithGoModWithoutGoDirectiveUsesMinGoVersion(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.MinGoVersion = "1.16"
+
+	b := newTestBuilder(t, map[string]string{
+		"go.mod":  "module example.com/example\n",
+		"main.go": "package main\n\nfunc main() {}\n",
+	}, cfg)
+
+	if b.Code.MinGoVersion.String() != "1.16.0" {
+		t.Errorf("expected min go version 1.16.0, got %v", b.Code.MinGoVersion)
+	}
+}
+
+func TestParseDistListWithWindowsLineEndings(t *testing.T) {
+	archs := parseDistList("linux/amd64\r\nwindows/386\r\nwindows/amd64\r\n")
+
+	windows := archs["windows"]
+	if len(windows) != 2 || windows[0] != "windows/386" || windows[1] != "windows/amd64" {
+		t.Errorf("unexpected windows archs: %q", windows)
+	}
+
+	if len(archs["linux/amd64"]) != 1 {
+		t.Errorf("unexpected archs: %q", archs)
+	}
+}
+
+func TestNewBuilderSkipsMainFilesWithIgnoreBuildConstraint(t *testing.T) {
+	b := newTestBuilder(t, map[string]string{
+		"go.mod":            "module example.com/example\n\ngo 1.17\n",
+		"main.go":           "package main\n\nfunc main() {}\n",
+		"gen/main.go":       "//go:build ignore\n\npackage main\n\nfunc main() {}\n",
+		"oldgen/main.go":    "// +build ignore\n\npackage main\n\nfunc main() {}\n",
+		"linuxonly/main.go": "//go:build linux\n\npackage main\n\nfunc main() {}\n",
+	}, nil)
+
+	var names []string
+	for _, e := range b.Executables {
+		names = append(names, e.Name)
+	}
+
+	if len(names) != 2 || b.ExecutableByName("example") == nil || b.ExecutableByName("linuxonly") == nil {
+		t.Errorf("expected example and linuxonly executables, got %v", names)
+	}
+}
+
+func TestNewBuilderRejectsDuplicatedAssetBuildNames(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.BaseDir = t.TempDir()
+	cfg.License = "MIT"
+	cfg.AssetBuilds = []AssetBuild{
+		{Name: "ui", Run: []string{"npm", "run", "build"}, Output: "ui/dist"},
+		{Name: "ui", Run: []string{"npm", "run", "build"}, Output: "ui/dist"},
+	}
+
+	writeTestFiles(t, cfg.BaseDir, testMainFiles)
+
+	_, err := NewBuilder(cfg)
+	if err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+func TestValidateBaseDirFromNestedFolder(t *testing.T) {
+	root := t.TempDir()
+	writeTestFiles(t, root, testMainFiles)
+
+	nested := filepath.Join(root, "cmd", "tool")
+	err := os.MkdirAll(nested, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = validateBaseDir(nested, false)
+	if err == nil {
+		t.Error("expected an error without FindModuleRoot")
+	}
+
+	dir, err := validateBaseDir(nested, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected, err := filepath.Abs(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dir != expected {
+		t.Errorf("expected %v, got %v", expected, dir)
+	}
+}
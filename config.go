@@ -1,24 +1,387 @@
 package build
 
+import (
+	"compress/flate"
+	"reflect"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
 type BuilderConfig struct {
 	BaseDir string
+	// Use the closest parent of BaseDir with a go.mod or go.work file, so the builder can run from sub folders
+	FindModuleRoot bool
+	// Fail if the module in BaseDir is not this one. Empty skips the check.
+	ModulePath string
 
 	MainFileNames []string
 
-	// nil means all
+	// Paths of the go and git executables. Empty means searching them in PATH.
+	GoBinary  string
+	GitBinary string
+
+	// Version of the code. If empty, it is read from VersionFile, then from the git tag. If none is available, a
+	// devel version is created.
+	Version string
+	// text/template of the devel version, with the fields .Commit, .ShortCommit and .Date (yyyymmddhhmmss of the
+	// commit). The result must be a valid semver. Empty means "0.0.0-devel+{{.ShortCommit}}.{{.Date}}". For go's
+	// pseudo-version format use "v0.0.0-{{.Date}}-{{printf \"%.12s\" .Commit}}".
+	DevelVersionTemplate string
+	// Path of a file with the version, relative to BaseDir. It is ignored if it does not exist, and ignored with a
+	// warning if it does not have a valid version.
+	VersionFile string
+	// Prefix of the git tags with versions, as in myapp/v for myapp/v1.2.3 in a monorepo. Only tags with it are
+	// used, and it is removed before parsing the version. The tag target creates tags with it. Empty means v.
+	TagPrefix string
+
+	// Used when go.mod, or go.work, has no go directive. If empty, the installed go version is used.
+	MinGoVersion string
+
+	// nil means all, "host" means the arch of the go toolchain and "$TARGETPLATFORM" means the arch from the
+	// TARGETPLATFORM or TARGETOS/TARGETARCH environment variables set by docker buildx. Common aliases, like x86_64
+	// or aarch64, are accepted.
 	Archs []string
 
+	// The output of go tool dist list is cached in the user cache dir, per go version. Set this to ignore the
+	// cached value and recreate it.
+	RefreshDistListCache bool
+
+	// Archs (os/arch or only os) whose build failures are reported as warnings instead of failing the build. Their
+	// executables are not signed nor zipped. Useful for android and ios, that need external toolchains.
+	BestEffortArchs []string
+
+	// Make RunBuildAll continue with the other executables and archs after a build error, and return all the errors
+	KeepGoing bool
+
+	// By default the build target only builds for the host arch and the release target builds for all Archs.
+	// Set this to make build use all Archs and all create the zips too, as before.
+	BuildAllArchs bool
+
+	// Make build and build-all (and so all and release) only build the published executables. The build-publish
+	// target always does this.
+	BuildPublishedOnly bool
+
+	// Android NDK folder. When set, android archs are built with cgo, using the NDK clang for AndroidAPILevel (0
+	// means 21) as CC.
+	AndroidNDK      string
+	AndroidAPILevel int
+
+	// Compiler used to build the executables: "go" (the default) or "tinygo". With tinygo, PGO profiles, linker
+	// flags other than LDFlagsVars and the go only build args (-trimpath, -buildvcs and -mod) are ignored, and
+	// js/wasm and wasip1/wasm are built with the tinygo wasm targets.
+	Compiler string
+
+	// Passed as -buildvcs to go build: true, false or auto. Use false when the git info is not available, as in some
+	// shallow clones, and go build fails stamping it. Empty uses go's default behavior.
+	BuildVCS string
+
+	// Passed as -mod to go build, test and generate: mod, vendor or readonly. Empty uses go's default behavior.
+	ModMode string
+
+	// Passed as GOEXPERIMENT to the go build, test and generate commands, as in "rangefunc" or "loopvar,arenas". The
+	// experiments change the compiled code, so builds are only reproducible with the same value, and toolchains that
+	// don't support one of them fail the build.
+	GoExperiment string
+
+	// Microarchitecture level by GOARCH (or os/arch), as in {"arm": "7", "amd64": "v3"}. It is passed to go build in
+	// the matching variable (GOARM, GOAMD64, GO386, GOMIPS, ...) and added to the zip names, as in linux_arm_v7.
+	MicroArchs map[string]string
+
 	GCO             bool
 	PreserveSymbols bool
 	BuildArgs       []string
 	LDFlagsVars     map[string]string
 
+	// Extra flags passed to the linker. They and the LDFlagsVars values can be text/templates with the fields .Name,
+	// .Version, .Commit, .BuildDate, .OS and .Arch, as in "-X main.fullVersion={{.Version}}+{{.Commit}}".
+	LDFlags []string
+
+	// Strip only the DWARF debug info (-w) or only the symbol table (-s) when PreserveSymbols is true. With
+	// StripDWARF, stack traces still have the function names.
+	StripDWARF       bool
+	StripSymbolTable bool
+
+	// Names of executables that are published (zipped) or not, overriding the default of publishing all but the ones
+	// inside internal, examples or _examples folders. NoPublish has precedence.
+	Publish   []string
+	NoPublish []string
+
+	// PGO profiles passed to go build -pgo, by executable name, relative to BaseDir. They replace the default.pgo
+	// found in the executable folder, that is used when an executable has no entry here.
+	PGOProfiles map[string]string
+
+	// Extra builds of the executables, each with its own tags and flags. A variant of myapp named enterprise creates
+	// the myapp-enterprise executable, with its own targets.
+	Variants []Variant
+
+	// .env file, relative to BaseDir, read before building. It is ignored if it does not exist. Keys with a dot
+	// (like main.apiURL) are added to LDFlagsVars, the others to the go build environment. LDFlagsVars has
+	// precedence over the file, and main.version, main.buildDate and main.commit are always set by the builder.
+	EnvFile string
+
+	// Move the debug info of ELF executables to <executable>.debug, using objcopy, and strip it from the executable.
+	// The debug file is not added to the zips: the zip targets put it in its own <zip name>-debug archive. Needs
+	// PreserveSymbols.
+	SplitDebug bool
+
+	// Commands run before building the executables, like building a web UI that is embedded with go:embed. The
+	// build fails if they don't create their Output.
+	AssetBuilds []AssetBuild
+
+	// Make the builds depend on the deps target, that runs go mod download, so the modules are downloaded in a
+	// separate step
+	DownloadDepsBeforeBuild bool
+
+	// Generate a buildinfo_gen.go file with Version, Commit and BuildDate constants before building
+	GenerateBuildInfo bool
+	// Folder of the package where buildinfo_gen.go is created, relative to BaseDir. Empty means BaseDir.
+	BuildInfoPackageDir string
+
+	// Authenticode signing of windows executables. Signing is skipped if CertFile is empty.
+	WindowsSign struct {
+		// PKCS#12 file
+		CertFile     string
+		CertPassword string
+		TimestampURL string
+	}
+
+	// codesign and notarization of darwin executables. Only works on macOS hosts. Signing is skipped if Identity is
+	// empty.
+	MacSign struct {
+		Identity string
+
+		Notarize bool
+		// Credentials for notarytool. Either a keychain profile or Apple ID, team ID and app-specific password.
+		// When empty, AppleID, TeamID and Password are read from the APPLE_ID, APPLE_TEAM_ID and APPLE_PASSWORD
+		// environment variables.
+		KeychainProfile string
+		AppleID         string
+		TeamID          string
+		Password        string
+	}
+
+	// Packages whose test binaries are compiled, without running them, by the build-tests target. Archs uses the
+	// same format as Archs, and nil means the host arch.
+	TestBinaries struct {
+		Packages []string
+		Archs    []string
+	}
+
+	// Passed to go test by the test and coverage targets: TestParallel as -p, to limit the packages tested at the
+	// same time (0 uses go's default), and TestArgs as extra flags, like -count=1 or -timeout=5m.
+	TestParallel int
+	TestArgs     []string
+
+	// Args to run executables with, by name, after building them for the host arch, to check they work. For
+	// example {"myapp": {"--version"}}. The smoke target runs them, and all, release and the zip of the host arch
+	// depend on it.
+	SmokeTests map[string][]string
+
+	// Minimum total test coverage, in percent, checked by the coverage target. 0 disables the check.
+	MinCoverage float64
+
+	// Benchmarks run by the bench target. An empty BenchRegexp runs all, a zero BenchCount uses go's default.
+	BenchRegexp string
+	BenchCount  int
+	// Also write the bench output to build/bench.txt, to be compared with benchstat
+	BenchSaveOutput bool
+
+	// Push the tag created by the tag target, with git push --follow-tags
+	PushTags bool
+
+	// Group the changelog entries by conventional commit type (feat, fix, chore, ...)
+	ChangelogGroupByType bool
+
+	// Compression of the zip files: CompressionDefault, CompressionStore or a flate level from 1
+	// (CompressionFastest) to 9 (CompressionBest)
+	CompressionLevel int
+
+	// Format of the files created by the zip targets: zip (the default) or tar.zst. tar.zst uses ZstdLevel, from 1
+	// to 22, with 0 meaning the zstd default. The levels are mapped to the closest level of the Go zstd encoder.
+	ArchiveFormat string
+	ZstdLevel     int
+
+	// Add a build-info.json file to the zips, with name, version, commit, build date, os, arch and go version
+	ZipBuildInfo bool
+
+	// text/template used for the name of the executables, instead of the executable name. The fields are .Name,
+	// .Version, .Commit, .OS and .Arch. For example "{{.Name}}-v{{.Version}}". The -<os>-<arch> suffix and .exe
+	// are still added when needed.
+	BinaryNameTemplate string
+
+	// text/template for the folder of each arch inside build, with the fields .OS and .Arch. Empty means
+	// "{{.OS}}/{{.Arch}}". For example "{{.OS}}_{{.Arch}}".
+	ArchDirFormat string
+
+	// Name the executables <name>-<os>-<arch> and create them directly in the build folder, instead of in
+	// build/<os>/<arch>/<name>
+	IncludeArchInBinaryName bool
+
+	// Create the executables directly in the build folder. This is always done for executables with only one arch.
+	// With more than one arch, the arch is added to the name, as in IncludeArchInBinaryName.
+	FlatOutput bool
+
+	// Called by RunBuild with the full command line, after all the flags were added, just before running it. The
+	// result is the command line that is run. It uses the Console.RunInline format, so it starts with "cd <dir>" and
+	// the KEY=VALUE environment variables, followed by the go executable and its arguments.
+	BuildCommandHook func(exec ExecutableInfo, arch string, cmd []string) []string
+
+	// Folder for temporary files created while building, relative to BaseDir. Empty means the system temp folder.
+	TempDir string
+
+	// Remove the executable before building it, so a failed build does not leave the old one behind to be zipped
+	RemoveOutputBeforeBuild bool
+
+	// Remove the executables added to a zip, after all the targets of the run finish successfully, so the targets that
+	// use them after the zip, like image, still work. Executables that are not published are kept.
+	CleanBinariesAfterZip bool
+
+	// Only list the files that would be removed by the clean-zip target and CleanBinariesAfterZip, instead of
+	// removing them
+	DryRun bool
+
+	// OCI images with linux executables. The image target writes build/<name>-<version>-oci.tar, with the image of
+	// each linux arch of the executable, and image-push pushes it to the Image.Repository.
+	Images []Image
+
+	// How images are pushed: "daemonless" (the default) pushes all archs straight to the registry, using the docker
+	// credentials, and "docker" loads the image of the host arch into the docker daemon and pushes it with docker
+	ImageMode string
+
+	// Called by the zip targets for each zip, after it is written. The executable is still there, because
+	// CleanBinariesAfterZip only removes it at the end of the run. It runs inside the zip target, so it runs before
+	// the targets that depend on it, like all and release. An error fails the target. If it moves the zip,
+	// Builder.Artifacts still has the original path.
+	OnArtifact func(artifact Artifact) error
+
+	// Information about the executables for packaging. It is copied to each ExecutableInfo, with License defaulting
+	// to the code license.
+	Metadata Metadata
+
 	License      string
 	LicenseCheck struct {
 		Allowed     []string
 		Denied      []string
 		IgnoredDeps []string
+
+		// Only check the dependencies required directly in go.mod, or in the go.mod of any module of the go.work
+		DirectDepsOnly bool
+		// Only check the modules with packages linked into the executables, as listed by go list -deps for the host
+		// arch. Test and tool dependencies are ignored.
+		LinkedDepsOnly bool
+
+		// Check that the hashes of the downloaded modules match the ones in go.sum
+		VerifySums bool
 	}
+
+	// SPDX ID of the license of modules whose license files are not identified correctly, by module path. It is
+	// used even if the module has no license file.
+	LicenseOverrides map[string]string
+	// Identifies the license files, returning its SPDX ID, before the licensecheck scan. If it returns "", the scan
+	// is used.
+	LicenseClassifier func(module string, contents []byte) string
+
+	// Colors in the output: auto, always or never. auto disables colors when the output is not a terminal or when
+	// NO_COLOR is set.
+	Color string
+
+	// Don't print the progress of the targets, so the output has only what the targets write. Useful to read the
+	// output of the version target in scripts. Errors are still printed.
+	Quiet bool
+
+	// File, relative to BaseDir, that also receives all the output of the targets and the commands they run, like
+	// build/build.log. It is truncated each time targets are run. With Color auto, colors are disabled while logging.
+	LogFile string
+
+	// Maximum time to run targets. When it is exceeded, the running command is killed and the run fails. 0 means no
+	// limit.
+	Deadline time.Duration
+
+	// Write build/build-result.json after running targets, with the status and duration of each target and the
+	// artifacts created.
+	WriteResultFile bool
+
+	// Called after RunTarget, RunDefault and RunTargetsMatching, with their error, even if they fail. Useful to send
+	// notifications or upload logs. Its own error is printed, but it does not change the result of the run.
+	Finalizer func(err error) error
+
+	// Target used as Builder.DefaultTarget. If empty, all is used.
+	DefaultTarget string
+
+	// Don't create the default targets (build, test, zip, all, ...). Only custom targets and the ones added to
+	// Builder.Targets exist, and Builder.DefaultTarget is empty.
+	NoDefaultTargets bool
+
+	// Extra targets that run a command. They are added after the default targets.
+	CustomTargets []CustomTarget
+
+	// Named changes applied with NewBuilderWithProfile. Each one is called with a copy of this config and changes
+	// it, so it can also reset fields to their zero values. For example, a release profile can be
+	// func(cfg *BuilderConfig) { cfg.Archs = nil; cfg.PreserveSymbols = false }.
+	Profiles map[string]func(cfg *BuilderConfig)
+}
+
+const (
+	CompressionDefault = 0
+	CompressionStore   = -1
+	CompressionFastest = flate.BestSpeed
+	CompressionBest    = flate.BestCompression
+)
+
+type CustomTarget struct {
+	Name         string
+	Dependencies []string
+
+	// The command line to run, in the same format as Console.RunInline
+	Run []string
+
+	// Files created by the command, relative to BaseDir, added to Builder.Artifacts
+	Artifacts []string
+}
+
+type AssetBuild struct {
+	// Used in the target name: assets:<name>
+	Name string
+
+	// The command line to run, in the same format as Console.RunInline
+	Run []string
+
+	// File or folder, relative to BaseDir, that must exist after running. Folders must not be empty.
+	Output string
+}
+
+type Variant struct {
+	// Added to the executable name, as in <name>-<variant>
+	Name string
+
+	// Names of the executables that have this variant. Empty means all.
+	Executables []string
+
+	// Passed to go build as -tags
+	Tags []string
+	// Added to the ones of the executable
+	BuildArgs   []string
+	LDFlags     []string
+	LDFlagsVars map[string]string
+}
+
+type Image struct {
+	// Name of the executable. It is the only file in the image and its entrypoint.
+	Executable string
+
+	// Where image-push pushes the image, like ghcr.io/me/app
+	Repository string
+	// Tags pushed. Empty means the version and latest.
+	Tags []string
+}
+
+type Metadata struct {
+	Description string
+	Homepage    string
+	Maintainer  string
+	License     string
+	Keywords    []string
 }
 
 func NewBuilderConfig() *BuilderConfig {
@@ -39,6 +402,57 @@ func NewBuilderConfig() *BuilderConfig {
 	result.PreserveSymbols = true
 	result.BuildArgs = []string{"-trimpath"}
 	result.LDFlagsVars = map[string]string{}
+	result.Color = "auto"
 
 	return result
 }
+
+// WithProfile returns a copy of this config with the named profile applied over it.
+func (c *BuilderConfig) WithProfile(name string) (*BuilderConfig, error) {
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return nil, errors.Errorf("unknown profile: %v", name)
+	}
+
+	result := *c
+	copyReferences(reflect.ValueOf(&result).Elem())
+
+	profile(&result)
+
+	return &result, nil
+}
+
+// copyReferences replaces the maps and slices of the struct with copies, so changing them does not change the
+// original struct
+func copyReferences(v reflect.Value) {
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Field(i)
+		if !f.CanSet() {
+			continue
+		}
+
+		switch f.Kind() {
+		case reflect.Struct:
+			copyReferences(f)
+
+		case reflect.Map:
+			if f.IsNil() {
+				continue
+			}
+
+			m := reflect.MakeMapWithSize(f.Type(), f.Len())
+			it := f.MapRange()
+			for it.Next() {
+				m.SetMapIndex(it.Key(), it.Value())
+			}
+			f.Set(m)
+
+		case reflect.Slice:
+			if f.IsNil() {
+				continue
+			}
+
+			f.Set(reflect.AppendSlice(reflect.MakeSlice(f.Type(), 0, f.Len()), f))
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package build
+
+import (
+	"testing"
+)
+
+func TestWithProfileCanResetFields(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.Archs = []string{"host"}
+	cfg.LDFlagsVars["main.x"] = "base"
+	cfg.Profiles = map[string]func(cfg *BuilderConfig){
+		"release": func(cfg *BuilderConfig) {
+			cfg.Archs = nil
+			cfg.PreserveSymbols = false
+			cfg.LDFlagsVars["main.x"] = "release"
+			cfg.BuildArgs = append(cfg.BuildArgs[:0], "-v")
+		},
+	}
+
+	release, err := cfg.WithProfile("release")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if release.PreserveSymbols {
+		t.Error("expected PreserveSymbols to be false")
+	}
+	if release.Archs != nil {
+		t.Errorf("expected no archs, got %v", release.Archs)
+	}
+
+	if !cfg.PreserveSymbols || len(cfg.Archs) != 1 {
+		t.Error("the profile changed the original config")
+	}
+	if cfg.LDFlagsVars["main.x"] != "base" || cfg.BuildArgs[0] != "-trimpath" {
+		t.Error("the profile changed the maps or slices of the original config")
+	}
+
+	_, err = cfg.WithProfile("missing")
+	if err == nil {
+		t.Error("expected an error for an unknown profile")
+	}
+}
@@ -1,7 +1,10 @@
 package build
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -13,6 +16,8 @@ import (
 func CreateConsole(dir string) (*Console, error) {
 	c := &Console{
 		Dir: dir,
+		Out: os.Stdout,
+		Err: os.Stderr,
 	}
 
 	return c, nil
@@ -20,6 +25,14 @@ func CreateConsole(dir string) (*Console, error) {
 
 type Console struct {
 	Dir string
+	Out io.Writer
+	Err io.Writer
+
+	// Values replaced by *** when printing the commands executed
+	Secrets []string
+
+	// If set, running commands are killed when it is done
+	Context context.Context
 }
 
 func (r *Console) FindExecutable(cmd string) (string, error) {
@@ -37,22 +50,47 @@ func (r *Console) FindExecutable(cmd string) (string, error) {
 }
 
 func (r *Console) RunInline(args ...interface{}) error {
+	return r.runInline(r.Err, args)
+}
+
+// RunInlineCapturingErr works as RunInline, but also returns what the command wrote to stderr.
+func (r *Console) RunInlineCapturingErr(args ...interface{}) (string, error) {
+	var stderr bytes.Buffer
+
+	err := r.runInline(io.MultiWriter(r.Err, &stderr), args)
+
+	return stderr.String(), err
+}
+
+func (r *Console) runInline(stderr io.Writer, args []interface{}) error {
 	cmd, err := r.createCommand(args)
 	if err != nil {
 		return err
 	}
 
 	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = r.Out
+	cmd.Stderr = stderr
 
+	fmt.Fprintf(r.Out, "Executing %v\n", r.FormatCommand(args...))
+
+	return cmd.Run()
+}
+
+// FormatCommand returns the command as printed by RunInline, with the secrets replaced by ***.
+func (r *Console) FormatCommand(args ...interface{}) string {
 	tmp := make([]string, len(args))
 	for i, a := range args {
 		tmp[i] = fmt.Sprint(a)
+
+		for _, s := range r.Secrets {
+			if s != "" {
+				tmp[i] = strings.ReplaceAll(tmp[i], s, "***")
+			}
+		}
 	}
-	fmt.Printf("Executing '%v'\n", strings.Join(tmp, "' '"))
 
-	return cmd.Run()
+	return "'" + strings.Join(tmp, "' '") + "'"
 }
 
 func (r *Console) RunAndReturnOutput(args ...interface{}) (string, error) {
@@ -63,6 +101,11 @@ func (r *Console) RunAndReturnOutput(args ...interface{}) (string, error) {
 
 	output, err := cmd.Output()
 	if err != nil {
+		// Output captures stderr in the error, so it can be shown
+		if exitErr, ok := err.(*exec.ExitError); ok && len(bytes.TrimSpace(exitErr.Stderr)) > 0 {
+			return "", errors.Wrapf(err, "error calling %v %v: %s", cmd.Path, cmd.Args, bytes.TrimSpace(exitErr.Stderr))
+		}
+
 		return "", errors.Wrapf(err, "error calling %v %v", cmd.Path, cmd.Args)
 	}
 
@@ -87,7 +130,7 @@ func (r *Console) createCommand(args []interface{}) (*exec.Cmd, error) {
 		case i == 0 && strings.HasPrefix(s, "cd "):
 			dir = s[3:]
 			if !filepath.IsAbs(dir) {
-				filepath.Join(r.Dir, s[3:])
+				dir = filepath.Join(r.Dir, dir)
 			}
 			dir, err = filepath.Abs(dir)
 			if err != nil {
@@ -105,7 +148,12 @@ func (r *Console) createCommand(args []interface{}) (*exec.Cmd, error) {
 		}
 	}
 
-	cmd := exec.Command(name, cargs...)
+	var cmd *exec.Cmd
+	if r.Context != nil {
+		cmd = exec.CommandContext(r.Context, name, cargs...)
+	} else {
+		cmd = exec.Command(name, cargs...)
+	}
 	cmd.Dir = dir
 	cmd.Env = append(os.Environ(), env...)
 
@@ -0,0 +1,25 @@
+package build
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestConsoleRunsRelativeCdInsideDir(t *testing.T) {
+	dir := t.TempDir()
+
+	c, err := CreateConsole(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd, err := c.createCommand([]interface{}{"cd sub", "go", "version"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := filepath.Join(dir, "sub")
+	if cmd.Dir != expected {
+		t.Errorf("expected dir %v, got %v", expected, cmd.Dir)
+	}
+}
@@ -0,0 +1,156 @@
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+type doctorResult int
+
+const (
+	doctorPass doctorResult = iota
+	doctorWarn
+	doctorFail
+)
+
+// RunDoctor checks the environment needed by the configured build and prints a report. It fails if any check
+// fails, warnings only show problems that may happen.
+func (b *Builder) RunDoctor() error {
+	output := b.newColorOutput(b.Out)
+
+	failed := 0
+	report := func(result doctorResult, format string, a ...interface{}) {
+		p, color := "✓", "2"
+		switch result {
+		case doctorWarn:
+			p, color = "!", "11"
+		case doctorFail:
+			p, color = "✗", "1"
+			failed++
+		}
+
+		fmt.Fprintf(b.Out, "%v %v\n", output.String(p).Foreground(output.Color(color)), fmt.Sprintf(format, a...))
+	}
+
+	if b.GO_VERSION.LessThan(b.Code.MinGoVersion) {
+		report(doctorFail, "go %v is older than the minimum %v", b.GO_VERSION, b.Code.MinGoVersion)
+	} else {
+		report(doctorPass, "go %v (minimum %v): %v", b.GO_VERSION, b.Code.MinGoVersion, b.GO)
+	}
+
+	if b.TINYGO != "" {
+		report(doctorPass, "tinygo: %v", b.TINYGO)
+	}
+
+	if b.GIT == "" {
+		report(doctorWarn, "git not found: version, commit and changelog are not available")
+	} else {
+		report(doctorPass, "git: %v", b.GIT)
+	}
+
+	archs := map[string]bool{}
+	for _, e := range b.Executables {
+		for _, a := range e.Archs {
+			archs[a] = true
+		}
+	}
+	report(doctorPass, "%v executables for %v archs", len(b.Executables), len(archs))
+
+	var sortedArchs []string
+	for a := range archs {
+		sortedArchs = append(sortedArchs, a)
+	}
+	sort.Strings(sortedArchs)
+
+	var bestEffort []string
+	var noCC []string
+	for _, a := range sortedArchs {
+		if b.isBestEffortArch(a) {
+			bestEffort = append(bestEffort, a)
+		}
+		if b.cfg.GCO && b.missingCrossCompiler(a) {
+			noCC = append(noCC, a)
+		}
+	}
+	if len(bestEffort) > 0 {
+		report(doctorWarn, "build failures are ignored for: %v", strings.Join(bestEffort, ", "))
+	}
+	if len(noCC) > 0 {
+		report(doctorWarn, "cgo is enabled and CC is not set, these archs need a C cross compiler: %v",
+			strings.Join(noCC, ", "))
+	}
+
+	buildDir := filepath.Join(b.Code.BaseDir, "build")
+	if err := checkWritable(buildDir); err != nil {
+		report(doctorFail, "output folder is not writable: %v", err)
+	} else {
+		report(doctorPass, "output folder is writable: %v", buildDir)
+	}
+
+	if b.cfg.WindowsSign.CertFile != "" {
+		tool := "osslsigncode"
+		if b.GO_GOOS == "windows" {
+			tool = "signtool"
+		}
+
+		b.doctorCheckFile(report, "windows signing certificate", b.cfg.WindowsSign.CertFile)
+		b.doctorCheckExecutable(report, tool)
+	}
+
+	if b.cfg.MacSign.Identity != "" {
+		if b.GO_GOOS != "darwin" {
+			report(doctorWarn, "macOS signing is configured, but it is skipped when not running on macOS")
+		} else {
+			b.doctorCheckExecutable(report, "codesign")
+			if b.cfg.MacSign.Notarize {
+				b.doctorCheckExecutable(report, "xcrun")
+			}
+		}
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%v checks failed", failed)
+	}
+
+	return nil
+}
+
+func (b *Builder) doctorCheckExecutable(report func(doctorResult, string, ...interface{}), name string) {
+	path, err := b.Console.FindExecutable(name)
+	if err != nil {
+		report(doctorFail, "%v not found in PATH", name)
+	} else {
+		report(doctorPass, "%v: %v", name, path)
+	}
+}
+
+func (b *Builder) doctorCheckFile(report func(doctorResult, string, ...interface{}), desc string, path string) {
+	_, err := os.Stat(path)
+	if err != nil {
+		report(doctorFail, "%v: %v", desc, err)
+	} else {
+		report(doctorPass, "%v: %v", desc, path)
+	}
+}
+
+func checkWritable(dir string) error {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(dir, ".doctor-")
+	if err != nil {
+		return err
+	}
+
+	name := f.Name()
+	_ = f.Close()
+
+	return os.Remove(name)
+}
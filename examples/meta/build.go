@@ -15,7 +15,7 @@ func main() {
 		panic(err)
 	}
 
-	err = b.RunTarget("all")
+	err = b.RunDefault()
 	if err != nil {
 		panic(err)
 	}
@@ -12,7 +12,7 @@ func main() {
 		panic(err)
 	}
 
-	err = b.RunTarget("all")
+	err = b.RunDefault()
 	if err != nil {
 		panic(err)
 	}
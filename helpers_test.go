@@ -0,0 +1,59 @@
+package build
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeTestFiles creates the files, by path relative to dir, with their contents
+func writeTestFiles(t *testing.T, dir string, files map[string]string) {
+	t.Helper()
+
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+
+		err := os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(path, []byte(contents), 0o644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestBuilder creates a builder for a module with the files in a temp folder. cfg can be nil, and its BaseDir
+// is replaced by the temp folder.
+func newTestBuilder(t *testing.T, files map[string]string, cfg *BuilderConfig) *Builder {
+	t.Helper()
+
+	if cfg == nil {
+		cfg = NewBuilderConfig()
+	}
+
+	cfg.BaseDir = t.TempDir()
+	if cfg.License == "" {
+		cfg.License = "MIT"
+	}
+
+	writeTestFiles(t, cfg.BaseDir, files)
+
+	b, err := NewBuilder(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.SetOutput(io.Discard, io.Discard)
+
+	return b
+}
+
+// testMainFiles are the files of a module with one executable, example
+var testMainFiles = map[string]string{
+	"go.mod":  "module example.com/example\n\ngo 1.17\n",
+	"main.go": "package main\n\nfunc main() {}\n",
+}
@@ -0,0 +1,389 @@
+package build
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/go-containerregistry/pkg/authn"
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/remote"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/pkg/errors"
+)
+
+// GetOutputImageName returns the OCI archive created by the image target of an executable.
+func (b *Builder) GetOutputImageName(exec ExecutableInfo) (string, error) {
+	name := fixFilename(fmt.Sprintf("%v-%v-oci.tar", exec.Name, b.Code.Version))
+
+	return filepath.Abs(filepath.Join(b.Code.BaseDir, "build", name))
+}
+
+// RunImage writes an OCI image archive with the linux executables of the archs, one image per arch. The executable
+// is the only file in the image, in /, and is its entrypoint. With ImageMode "docker" the image of the host arch is
+// also loaded into the docker daemon, with the tags of the Image.
+func (b *Builder) RunImage(img Image, exec ExecutableInfo, archs []string) error {
+	if len(archs) == 0 {
+		return errors.Errorf("no linux executable of %v to create the image", exec.Name)
+	}
+
+	output, err := b.GetOutputImageName(exec)
+	if err != nil {
+		return err
+	}
+
+	index, images, err := b.createImageIndex(exec, archs)
+	if err != nil {
+		return err
+	}
+
+	err = b.writeImageArchive(output, index)
+	if err != nil {
+		return err
+	}
+
+	_, err = b.addArtifact(output, "image", exec, "")
+	if err != nil {
+		return err
+	}
+
+	if b.cfg.ImageMode == "docker" {
+		return b.loadImageIntoDocker(img, exec, images)
+	}
+
+	return nil
+}
+
+// createImageIndex returns the index with the image of each arch, and the images by arch
+func (b *Builder) createImageIndex(exec ExecutableInfo, archs []string) (v1.ImageIndex, map[string]v1.Image, error) {
+	index := mutate.IndexMediaType(empty.Index, types.OCIImageIndex)
+	images := map[string]v1.Image{}
+
+	for _, arch := range archs {
+		outputExec, err := b.GetOutputExecutableName(exec, arch)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		data, err := os.ReadFile(outputExec)
+		if err != nil {
+			return nil, nil, errors.Wrapf(err, "error accessing compiled executable %v", outputExec)
+		}
+
+		layerData, err := b.createImageLayer(filepath.Base(outputExec), data)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		layer, err := tarball.LayerFromOpener(func() (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(layerData)), nil
+		}, tarball.WithMediaType(types.OCILayer))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		image, err := mutate.AppendLayers(mutate.MediaType(empty.Image, types.OCIManifestSchema1), layer)
+		if err != nil {
+			return nil, nil, err
+		}
+		image = mutate.ConfigMediaType(image, types.OCIConfigJSON)
+
+		goos, goarch := splitArch(arch)
+
+		cfg, err := image.ConfigFile()
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg = cfg.DeepCopy()
+		cfg.OS = goos
+		cfg.Architecture = goarch
+		cfg.Created = v1.Time{Time: b.Code.BuildDate.UTC()}
+		cfg.Config.Entrypoint = []string{"/" + filepath.Base(outputExec)}
+
+		image, err = mutate.ConfigFile(image, cfg)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		images[arch] = image
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add: image,
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{
+					OS:           goos,
+					Architecture: goarch,
+				},
+			},
+		})
+	}
+
+	index = mutate.Annotations(index, map[string]string{
+		"org.opencontainers.image.version":  b.Code.Version.String(),
+		"org.opencontainers.image.revision": b.Git.Commit,
+	}).(v1.ImageIndex)
+
+	return index, images, nil
+}
+
+// createImageLayer returns the uncompressed layer tar with the executable
+func (b *Builder) createImageLayer(name string, data []byte) ([]byte, error) {
+	var result bytes.Buffer
+
+	tw := tar.NewWriter(&result)
+
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0o755,
+		Size:    int64(len(data)),
+		ModTime: b.Code.BuildDate,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tw.Write(data)
+	if err != nil {
+		return nil, err
+	}
+
+	err = tw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	return result.Bytes(), nil
+}
+
+// writeImageArchive writes the index as an OCI layout and stores it in the output tar
+func (b *Builder) writeImageArchive(output string, index v1.ImageIndex) error {
+	staging, err := b.createTempDir("image-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	_, err = layout.Write(staging, index)
+	if err != nil {
+		return err
+	}
+
+	return createFileAtomic(output, func(w io.Writer) error {
+		tw := tar.NewWriter(w)
+
+		err := filepath.WalkDir(staging, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+
+			rel, err := filepath.Rel(staging, path)
+			if err != nil {
+				return err
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			err = tw.WriteHeader(&tar.Header{
+				Name:    filepath.ToSlash(rel),
+				Mode:    0o644,
+				Size:    int64(len(data)),
+				ModTime: b.Code.BuildDate,
+			})
+			if err != nil {
+				return err
+			}
+
+			_, err = tw.Write(data)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		return tw.Close()
+	})
+}
+
+// readImageArchive extracts the OCI archive to dir and returns its index
+func readImageArchive(archive string, dir string) (v1.ImageIndex, error) {
+	f, err := os.Open(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	tr := tar.NewReader(f)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Wrapf(err, "error reading image archive %v", archive)
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		name := filepath.Clean(filepath.FromSlash(header.Name))
+		if filepath.IsAbs(name) || name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+			return nil, errors.Errorf("invalid file in image archive %v: %v", archive, header.Name)
+		}
+
+		path := filepath.Join(dir, name)
+
+		err = os.MkdirAll(filepath.Dir(path), 0o755)
+		if err != nil {
+			return nil, err
+		}
+
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			return nil, err
+		}
+
+		err = os.WriteFile(path, data, 0o644)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return layout.ImageIndexFromPath(dir)
+}
+
+// getImageTags returns the references of the tags of the image, in repository
+func (b *Builder) getImageTags(img Image, repository string) ([]name.Tag, error) {
+	tags := img.Tags
+	if len(tags) == 0 {
+		// Tags can't have the + of the semver build metadata
+		tags = []string{strings.ReplaceAll(b.Code.Version.String(), "+", "_"), "latest"}
+	}
+
+	var result []name.Tag
+	for _, tag := range tags {
+		ref, err := name.NewTag(repository + ":" + tag)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid image tag %v", tag)
+		}
+
+		result = append(result, ref)
+	}
+
+	return result, nil
+}
+
+// loadImageIntoDocker loads the image of the host arch into the docker daemon, with the tags of the Image. The daemon
+// can only hold one arch of an image.
+func (b *Builder) loadImageIntoDocker(img Image, exec ExecutableInfo, images map[string]v1.Image) error {
+	arch := "linux/" + b.GO_GOARCH
+
+	image, ok := images[arch]
+	if !ok {
+		return errors.Errorf("image of %v needs %v in Archs to be loaded into docker", exec.Name, arch)
+	}
+
+	docker, err := b.Console.FindExecutable("docker")
+	if err != nil {
+		return err
+	}
+
+	repository := img.Repository
+	if repository == "" {
+		repository = exec.Name
+	}
+
+	tags, err := b.getImageTags(img, repository)
+	if err != nil {
+		return err
+	}
+
+	refs := map[name.Reference]v1.Image{}
+	for _, tag := range tags {
+		refs[tag] = image
+	}
+
+	staging, err := b.createTempDir("image-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	file := filepath.Join(staging, "image.tar")
+
+	err = tarball.MultiRefWriteToFile(file, refs)
+	if err != nil {
+		return err
+	}
+
+	return b.Console.RunInline(docker, "load", "-i", file)
+}
+
+// RunImagePush pushes the image to the Image.Repository. By default, it pushes the image archive, with all its archs,
+// straight to the registry, using the docker credentials. With ImageMode "docker" it pushes the image loaded into the
+// docker daemon by the image target.
+func (b *Builder) RunImagePush(img Image, exec ExecutableInfo) error {
+	if img.Repository == "" {
+		return errors.Errorf("image of %v has no repository to push to", exec.Name)
+	}
+
+	tags, err := b.getImageTags(img, img.Repository)
+	if err != nil {
+		return err
+	}
+
+	if b.cfg.ImageMode == "docker" {
+		docker, err := b.Console.FindExecutable("docker")
+		if err != nil {
+			return err
+		}
+
+		for _, tag := range tags {
+			err = b.Console.RunInline(docker, "push", tag.String())
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	output, err := b.GetOutputImageName(exec)
+	if err != nil {
+		return err
+	}
+
+	staging, err := b.createTempDir("image-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	index, err := readImageArchive(output, staging)
+	if err != nil {
+		return err
+	}
+
+	for _, tag := range tags {
+		fmt.Fprintf(b.Out, "Pushing %v\n", tag)
+
+		err = remote.WriteIndex(tag, index, remote.WithAuthFromKeychain(authn.DefaultKeychain))
+		if err != nil {
+			return errors.Wrapf(err, "error pushing image %v", tag)
+		}
+	}
+
+	return nil
+}
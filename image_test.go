@@ -0,0 +1,89 @@
+package build
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunImageWritesIndexWithAllArchs(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.Archs = []string{"linux/amd64", "linux/arm64"}
+
+	b := newTestBuilder(t, testMainFiles, cfg)
+
+	exec := b.Executables[0]
+
+	for _, arch := range exec.Archs {
+		output, err := b.GetOutputExecutableName(exec, arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.MkdirAll(filepath.Dir(output), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(output, []byte(arch), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := b.RunImage(Image{Executable: exec.Name}, exec, exec.Archs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := b.GetOutputImageName(exec)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	index, err := readImageArchive(output, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var platforms []string
+	for _, m := range manifest.Manifests {
+		platforms = append(platforms, m.Platform.OS+"/"+m.Platform.Architecture)
+
+		img, err := index.Image(m.Digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config, err := img.ConfigFile()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(config.Config.Entrypoint) != 1 || config.Config.Entrypoint[0] != "/example" {
+			t.Errorf("unexpected entrypoint: %v", config.Config.Entrypoint)
+		}
+	}
+
+	if len(platforms) != 2 || platforms[0] != "linux/amd64" || platforms[1] != "linux/arm64" {
+		t.Errorf("unexpected platforms: %v", platforms)
+	}
+}
+
+func TestNewBuilderRejectsInvalidImageMode(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.BaseDir = t.TempDir()
+	cfg.ImageMode = "podman"
+
+	writeTestFiles(t, cfg.BaseDir, testMainFiles)
+
+	_, err := NewBuilder(cfg)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+}
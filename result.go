@@ -0,0 +1,191 @@
+package build
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Artifact is a file produced by a target.
+type Artifact struct {
+	Path string `json:"path"`
+	// executable, debug, zip, debug-zip, image, notices or the kind given to RegisterArtifact
+	Kind       string `json:"kind"`
+	Executable string `json:"executable,omitempty"`
+	Arch       string `json:"arch,omitempty"`
+	Size       int64  `json:"size"`
+	SHA256     string `json:"sha256"`
+}
+
+// BuildResult is the summary written to build/build-result.json when BuilderConfig.WriteResultFile is set.
+type BuildResult struct {
+	Target    string         `json:"target"`
+	Success   bool           `json:"success"`
+	Error     string         `json:"error,omitempty"`
+	Version   string         `json:"version"`
+	Targets   []TargetResult `json:"targets"`
+	Artifacts []Artifact     `json:"artifacts"`
+}
+
+type TargetResult struct {
+	Name string `json:"name"`
+	// success, failed or skipped
+	Status          string  `json:"status"`
+	DurationSeconds float64 `json:"durationSeconds"`
+}
+
+// Artifacts returns the files produced by the last run.
+func (b *Builder) Artifacts() []Artifact {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	result := make([]Artifact, len(b.artifacts))
+	copy(result, b.artifacts)
+	return result
+}
+
+// RegisterArtifact adds a file created by a target to Artifacts and to the result file. It is meant to be called by
+// the run func of custom targets. The path is relative to BaseDir and kind describes the file, like "custom".
+func (b *Builder) RegisterArtifact(path string, kind string) error {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(b.Code.BaseDir, path)
+	}
+
+	_, err := b.addArtifact(path, kind, ExecutableInfo{}, "")
+	if err != nil {
+		return errors.Wrapf(err, "error registering artifact")
+	}
+
+	return nil
+}
+
+// addArtifact hashes the file and adds it to the artifacts, replacing any artifact with the same path
+func (b *Builder) addArtifact(path, kind string, exec ExecutableInfo, arch string) (Artifact, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return Artifact{}, err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+
+	size, err := io.Copy(hash, f)
+	if err != nil {
+		return Artifact{}, err
+	}
+
+	result := Artifact{
+		Path:       path,
+		Kind:       kind,
+		Executable: exec.Name,
+		Arch:       arch,
+		Size:       size,
+		SHA256:     hex.EncodeToString(hash.Sum(nil)),
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.removeArtifactLocked(path)
+	b.artifacts = append(b.artifacts, result)
+
+	return result, nil
+}
+
+func (b *Builder) removeArtifact(path string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.removeArtifactLocked(path)
+}
+
+func (b *Builder) removeArtifactLocked(path string) {
+	for i, a := range b.artifacts {
+		if a.Path == path {
+			b.artifacts = append(b.artifacts[:i], b.artifacts[i+1:]...)
+			return
+		}
+	}
+}
+
+// resetRunState forgets the artifacts, failed builds, executable validations and zipped binaries of previous runs
+func (b *Builder) resetRunState() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.artifacts = nil
+	b.failedBuilds = map[string]bool{}
+	b.validatedExecutables = map[string]error{}
+	b.zippedBinaries = nil
+}
+
+// addZippedBinary records an executable added to a zip, to be removed at the end of the run by CleanBinariesAfterZip
+func (b *Builder) addZippedBinary(path string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !containsString(b.zippedBinaries, path) {
+		b.zippedBinaries = append(b.zippedBinaries, path)
+	}
+}
+
+// setBuildFailed records that the build target of a best effort arch failed
+func (b *Builder) setBuildFailed(target string) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.failedBuilds[target] = true
+}
+
+func (b *Builder) buildFailed(target string) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	return b.failedBuilds[target]
+}
+
+func (b *Builder) writeResultFile(name string, ts []string, durations []time.Duration, runErr error) error {
+	result := BuildResult{
+		Target:    name,
+		Success:   runErr == nil,
+		Version:   b.Code.Version.String(),
+		Targets:   []TargetResult{},
+		Artifacts: b.Artifacts(),
+	}
+
+	if runErr != nil {
+		result.Error = runErr.Error()
+	}
+
+	for i, n := range ts {
+		tr := TargetResult{
+			Name: n,
+		}
+
+		switch {
+		case i >= len(durations):
+			tr.Status = "skipped"
+		case i == len(durations)-1 && runErr != nil:
+			tr.Status = "failed"
+		default:
+			tr.Status = "success"
+		}
+
+		if i < len(durations) {
+			tr.DurationSeconds = durations[i].Seconds()
+		}
+
+		result.Targets = append(result.Targets, tr)
+	}
+
+	if result.Artifacts == nil {
+		result.Artifacts = []Artifact{}
+	}
+
+	return writeJSONFile(filepath.Join(b.Code.BaseDir, "build", "build-result.json"), result)
+}
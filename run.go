@@ -1,22 +1,41 @@
 package build
 
 import (
+	"archive/tar"
 	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"go/parser"
+	"go/token"
 	"io"
+	"io/fs"
 	"os"
+	"path"
 	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
 
-	"github.com/google/licensecheck"
+	"github.com/Masterminds/semver/v3"
+	"github.com/klauspost/compress/zstd"
 	"github.com/muesli/termenv"
 	"github.com/pkg/errors"
 )
 
 func (b *Builder) RunTarget(name string) error {
+	return b.finalize(b.runTarget(name))
+}
+
+func (b *Builder) runTarget(name string) error {
 	if b.GO_VERSION.LessThan(b.Code.MinGoVersion) {
 		return errors.Errorf("unsupported go version %v - shold be at least %v", b.GO_VERSION, b.Code.MinGoVersion)
 	}
@@ -26,169 +45,2162 @@ func (b *Builder) RunTarget(name string) error {
 		return err
 	}
 
-	printf := func(i int, format string, a ...interface{}) {
-		fmt.Printf("[%v %v/%v] %v\n", time.Now().Format("15:04:05"), i, len(ts), fmt.Sprintf(format, a...))
+	return b.runTargets(name, ts)
+}
+
+// RunDefault runs Builder.DefaultTarget.
+func (b *Builder) RunDefault() error {
+	if b.DefaultTarget == "" {
+		return errors.New("no default target")
 	}
 
-	for i, n := range ts {
-		printf(i, "Executing target %v", n)
+	return b.RunTarget(b.DefaultTarget)
+}
+
+// RunTargetsMatching runs all targets whose names match the glob pattern (see Targets.Match).
+func (b *Builder) RunTargetsMatching(pattern string) error {
+	return b.finalize(b.runTargetsMatching(pattern))
+}
+
+func (b *Builder) runTargetsMatching(pattern string) error {
+	if b.GO_VERSION.LessThan(b.Code.MinGoVersion) {
+		return errors.Errorf("unsupported go version %v - shold be at least %v", b.GO_VERSION, b.Code.MinGoVersion)
+	}
+
+	names := b.Targets.Match(pattern)
+	if len(names) == 0 {
+		return errors.Errorf("no targets match: %v", pattern)
+	}
+
+	ts, err := b.Targets.ComputeTargetsRunOrder(names...)
+	if err != nil {
+		return err
+	}
+
+	return b.runTargets(pattern, ts)
+}
+
+// ExportTargetGraph writes the targets dependency graph, in graphviz dot or mermaid format.
+func (b *Builder) ExportTargetGraph(w io.Writer, format string) error {
+	return b.Targets.WriteGraph(w, format)
+}
+
+// finalize calls BuilderConfig.Finalizer with the result of a run. Its error is only printed.
+func (b *Builder) finalize(err error) error {
+	if b.cfg.Finalizer == nil {
+		return err
+	}
+
+	ferr := b.cfg.Finalizer(err)
+	if ferr != nil {
+		fmt.Fprintf(b.Err, "ERROR running finalizer: %v\n", ferr)
+	}
+
+	return err
+}
+
+// Explain returns the plan to run a target, without running it: the targets that would run, in order, with the
+// command each one executes, or what it does when it runs go code. Targets added directly with Targets.Add are
+// described as custom func.
+func (b *Builder) Explain(name string) (string, error) {
+	ts, err := b.Targets.ComputeTargetRunOrder(name)
+	if err != nil {
+		return "", err
+	}
+
+	var result strings.Builder
+
+	fmt.Fprintf(&result, "Target %v runs %v targets:\n", name, len(ts))
 
+	for i, n := range ts {
 		t := b.Targets.Get(n)
-		err = t.run()
 
+		desc := "custom func"
+		if t.describe != nil {
+			desc, err = t.describe()
+			if err != nil {
+				return "", errors.Wrapf(err, "error describing target %v", n)
+			}
+		}
+
+		fmt.Fprintf(&result, "%v. %v\n   %v\n", i+1, n, desc)
+	}
+
+	return result.String(), nil
+}
+
+// runTargetInGroup runs the target, waiting for the other targets of its serialization group to finish
+func (b *Builder) runTargetInGroup(t *Target) error {
+	if t.SerializationGroup != "" {
+		b.mutex.Lock()
+		lock, ok := b.groupLocks[t.SerializationGroup]
+		if !ok {
+			lock = &sync.Mutex{}
+			b.groupLocks[t.SerializationGroup] = lock
+		}
+		b.mutex.Unlock()
+
+		lock.Lock()
+		defer lock.Unlock()
+	}
+
+	return t.run()
+}
+
+func (b *Builder) runTargets(name string, ts []string) error {
+	var err error
+
+	printf := func(w io.Writer, i int, color string, format string, a ...interface{}) {
+		if b.cfg.Quiet && w == b.Out {
+			return
+		}
+
+		output := b.newColorOutput(w)
+
+		prefix := output.String(fmt.Sprintf("[%v %v/%v]", time.Now().Format("15:04:05"), i, len(ts))).Faint()
+
+		msg := output.String(fmt.Sprintf(format, a...))
+		if color != "" {
+			msg = msg.Foreground(output.Color(color))
+		}
+
+		fmt.Fprintf(w, "%v %v\n", prefix, msg)
+	}
+
+	if b.cfg.LogFile != "" {
+		closeLog, err := b.startLogFile()
 		if err != nil {
-			printf(i, "ERROR executing target %v: %v", n, err)
 			return err
 		}
+		defer closeLog()
+	}
+
+	b.resetRunState()
+
+	var durations []time.Duration
+
+	if b.cfg.Deadline > 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), b.cfg.Deadline)
+		defer cancel()
+
+		b.Console.Context = ctx
+		defer func() { b.Console.Context = nil }()
+	}
+
+	for i, n := range ts {
+		printf(b.Out, i, "", "Executing target %v", n)
+
+		start := time.Now()
+
+		t := b.Targets.Get(n)
+		err = b.runTargetInGroup(t)
+
+		durations = append(durations, time.Since(start))
+
+		if ctx := b.Console.Context; ctx != nil && ctx.Err() != nil {
+			err = errors.Errorf("deadline of %v exceeded while running target %v", b.cfg.Deadline, n)
+		}
+
+		if err != nil {
+			printf(b.Err, i, "1", "ERROR executing target %v: %v", n, err)
+			break
+		}
+
+		if !b.cfg.Quiet {
+			fmt.Fprintln(b.Out)
+		}
+	}
+
+	if err == nil {
+		err = b.removeZippedBinaries()
+	}
+
+	if b.cfg.WriteResultFile {
+		rerr := b.writeResultFile(name, ts, durations, err)
+		if rerr != nil {
+			fmt.Fprintf(b.Err, "ERROR writing result file: %v\n", rerr)
+			if err == nil {
+				err = rerr
+			}
+		}
+	}
 
-		fmt.Println()
+	if err != nil {
+		return err
 	}
 
+	printf(b.Out, len(ts), "2", "Target %v executed successfully", name)
+
 	return nil
 }
 
-func (b *Builder) RunBuild(exec ExecutableInfo, arch string) error {
-	parts := strings.Split(arch, "/")
-	goos := parts[0]
-	goarch := parts[1]
+// PrintVersion writes the version to Builder.Out, alone in the line, so scripts can read it. With details, the
+// commit and build date are written in the following lines.
+func (b *Builder) PrintVersion(details bool) error {
+	fmt.Fprintln(b.Out, b.Code.Version)
 
-	var cmd []interface{}
+	if details {
+		if b.Git.Commit != "" {
+			fmt.Fprintf(b.Out, "commit: %v\n", b.Git.Commit)
+		}
+		fmt.Fprintf(b.Out, "date: %v\n", b.Code.BuildDate.Format(time.RFC3339))
+	}
 
-	cmd = append(cmd, "cd "+b.Code.BaseDir, "GOOS="+goos, "GOARCH="+goarch)
+	return nil
+}
 
-	if !exec.GCO {
-		cmd = append(cmd, "CGO_ENABLED=0")
+// RunFmtCheck fails if gofmt would change any go file of the module packages, listing them.
+func (b *Builder) RunFmtCheck() error {
+	gofmt, err := b.findGofmt()
+	if err != nil {
+		return err
 	}
 
-	cmd = append(cmd, b.GO, "build")
+	files, err := b.Console.RunAndReturnOutput(b.GO, "list", "-f",
+		`{{$d := .Dir}}{{range .GoFiles}}{{$d}}/{{.}}{{"\n"}}{{end}}{{range .CgoFiles}}{{$d}}/{{.}}{{"\n"}}{{end}}`+
+			`{{range .TestGoFiles}}{{$d}}/{{.}}{{"\n"}}{{end}}{{range .XTestGoFiles}}{{$d}}/{{.}}{{"\n"}}{{end}}`,
+		"./...")
+	if err != nil {
+		return err
+	}
 
-	for _, a := range exec.BuildArgs {
-		cmd = append(cmd, a)
+	cmd := []interface{}{gofmt, "-l"}
+	for _, f := range splitLines(files) {
+		cmd = append(cmd, f)
 	}
 
-	if len(exec.LDFlags) > 0 || len(exec.LDFlagsVars) > 0 {
-		ldflags := exec.LDFlags
-		for k, v := range exec.LDFlagsVars {
-			ldflags = append(ldflags, "-X", fmt.Sprintf(`"%v=%v"`, k, v))
+	if len(cmd) == 2 {
+		return nil
+	}
+
+	output, err := b.Console.RunAndReturnOutput(cmd...)
+	if err != nil {
+		return err
+	}
+
+	unformatted := splitLines(output)
+	if len(unformatted) == 0 {
+		fmt.Fprintln(b.Out, "All files are formatted")
+		return nil
+	}
+
+	for _, f := range unformatted {
+		rel, err := filepath.Rel(b.Code.BaseDir, f)
+		if err != nil {
+			rel = f
 		}
 
-		cmd = append(cmd, "-ldflags", strings.Join(ldflags, " "))
+		fmt.Fprintf(b.Out, "Not formatted: %v\n", rel)
 	}
 
-	output, err := b.GetOutputExecutableName(exec, arch)
+	return errors.Errorf("%v files are not formatted, run the fmt target", len(unformatted))
+}
+
+func (b *Builder) findGofmt() (string, error) {
+	name := "gofmt"
+	if b.GO_GOOS == "windows" {
+		name += ".exe"
+	}
+
+	// Use the one from the same go installation
+	gofmt := filepath.Join(filepath.Dir(b.GO), name)
+	if _, err := os.Stat(gofmt); err == nil {
+		return gofmt, nil
+	}
+
+	return b.Console.FindExecutable("gofmt")
+}
+
+// RunCoverage runs the tests writing the coverage profile to build/coverage.out and fails if the total coverage is
+// less than BuilderConfig.MinCoverage.
+func (b *Builder) RunCoverage() error {
+	profile := filepath.Join(b.Code.BaseDir, "build", "coverage.out")
+
+	err := os.MkdirAll(filepath.Dir(profile), 0o755)
 	if err != nil {
 		return err
 	}
 
-	cmd = append(cmd, "-o", output, exec.Path)
+	err = b.Console.RunInline(b.testCommand("-coverprofile="+profile, "./...")...)
+	if err != nil {
+		return err
+	}
 
-	return b.Console.RunInline(cmd...)
+	output, err := b.Console.RunAndReturnOutput(b.GO, "tool", "cover", "-func="+profile)
+	if err != nil {
+		return err
+	}
+
+	total, err := parseTotalCoverage(output)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(b.Out, "Total coverage: %.1f%%\n", total)
+
+	if total < b.cfg.MinCoverage {
+		return errors.Errorf("total coverage %.1f%% is below the minimum of %.1f%%", total, b.cfg.MinCoverage)
+	}
+
+	return nil
 }
 
-func (b *Builder) RunCleanZip() error {
-	buildDir, err := filepath.Abs(filepath.Join(b.Code.BaseDir, "build"))
+var totalCoverageRE = regexp.MustCompile(`(?m)^total:\s+\(statements\)\s+([0-9.]+)%`)
+
+func parseTotalCoverage(output string) (float64, error) {
+	parts := totalCoverageRE.FindStringSubmatch(output)
+	if parts == nil {
+		return 0, errors.Errorf("total coverage not found in go tool cover output")
+	}
+
+	return strconv.ParseFloat(parts[1], 64)
+}
+
+func (b *Builder) RunBench() error {
+	bench := b.cfg.BenchRegexp
+	if bench == "" {
+		bench = "."
+	}
+
+	cmd := b.goCommand("test", "-run=^$", "-bench="+bench, "-benchmem")
+	if b.cfg.BenchCount > 0 {
+		cmd = append(cmd, fmt.Sprintf("-count=%v", b.cfg.BenchCount))
+	}
+	cmd = append(cmd, "./...")
+
+	if !b.cfg.BenchSaveOutput {
+		return b.Console.RunInline(cmd...)
+	}
+
+	output := filepath.Join(b.Code.BaseDir, "build", "bench.txt")
+
+	err := os.MkdirAll(filepath.Dir(output), 0o755)
 	if err != nil {
 		return err
 	}
 
-	files, err := os.ReadDir(buildDir)
+	f, err := os.Create(output)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	for _, file := range files {
-		if file.IsDir() || !strings.HasSuffix(file.Name(), ".zip") {
-			continue
+	console := *b.Console
+	console.Out = io.MultiWriter(b.Console.Out, f)
+
+	return console.RunInline(cmd...)
+}
+
+// RunGenerateChanged runs go generate only in the packages that have changed since the last run. A package is
+// considered changed when any of its files changes, ignoring generated files.
+func (b *Builder) RunGenerateChanged() error {
+	cacheFile := filepath.Join(b.Code.BaseDir, "build", ".generate-cache.json")
+
+	cache := map[string]string{}
+	data, err := os.ReadFile(cacheFile)
+	if err == nil {
+		// Ignore errors: a broken cache only means everything is generated again
+		_ = json.Unmarshal(data, &cache)
+	}
+
+	dirs, err := b.findDirsWithGenerate()
+	if err != nil {
+		return err
+	}
+
+	newCache := map[string]string{}
+	for _, dir := range dirs {
+		rel, err := filepath.Rel(b.Code.BaseDir, dir)
+		if err != nil {
+			return err
 		}
+		rel = filepath.ToSlash(rel)
 
-		err = os.Remove(filepath.Join(buildDir, file.Name()))
+		hash, err := hashGenerateInputs(dir)
 		if err != nil {
 			return err
 		}
+
+		if cache[rel] != hash {
+			err = b.Console.RunInline(b.goCommand("generate", "./"+rel)...)
+			if err != nil {
+				_ = writeJSONFile(cacheFile, newCache)
+				return err
+			}
+		}
+
+		newCache[rel] = hash
+	}
+
+	return writeJSONFile(cacheFile, newCache)
+}
+
+func (b *Builder) findDirsWithGenerate() ([]string, error) {
+	dirs := map[string]bool{}
+
+	err := filepath.WalkDir(b.Code.BaseDir,
+		func(path string, entry fs.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+
+			if entry.IsDir() {
+				if path != b.Code.BaseDir && (strings.HasPrefix(entry.Name(), ".") || entry.Name() == "vendor") {
+					return filepath.SkipDir
+				}
+
+				return nil
+			}
+
+			if !strings.HasSuffix(entry.Name(), ".go") {
+				return nil
+			}
+
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+
+			if bytes.Contains(data, []byte("//go:generate ")) {
+				dirs[filepath.Dir(path)] = true
+			}
+
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+	for d := range dirs {
+		result = append(result, d)
+	}
+
+	sort.Strings(result)
+
+	return result, nil
+}
+
+var generatedFileRE = regexp.MustCompile(`(?m)^// Code generated .* DO NOT EDIT\.$`)
+
+func hashGenerateInputs(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return "", err
+		}
+
+		if generatedFileRE.Match(data) {
+			continue
+		}
+
+		_, _ = fmt.Fprintf(hash, "%v\n%v\n", entry.Name(), len(data))
+		_, _ = hash.Write(data)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// RunBuildAll builds all executables for all their archs, as the build-all target, but calling RunBuild directly
+// without its dependencies (build-info, assets). Build errors of best effort archs are only printed, as in the
+// targets. Any other error stops the build, unless KeepGoing is set: then the other builds still run and all the
+// errors are returned together in a BuildAllError.
+func (b *Builder) RunBuildAll() error {
+	b.resetRunState()
+
+	var errs []error
+
+	for _, exec := range b.Executables {
+		if !exec.Publish && b.cfg.BuildPublishedOnly {
+			continue
+		}
+
+		for _, arch := range exec.Archs {
+			err := b.RunBuild(exec, arch)
+			if err != nil && b.isBestEffortArch(arch) {
+				fmt.Fprintf(b.Err, "WARNING: Ignoring build error of best effort arch %v: %v\n", arch, err)
+				b.setBuildFailed("build:" + exec.TargetName() + ":" + arch)
+				continue
+			}
+			if err != nil {
+				err = errors.Wrapf(err, "error building %v for %v", exec.Name, arch)
+				if !b.cfg.KeepGoing {
+					return err
+				}
+
+				b.setBuildFailed("build:" + exec.TargetName() + ":" + arch)
+				errs = append(errs, err)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return &BuildAllError{Errors: errs}
 	}
 
 	return nil
 }
 
-func (b *Builder) RunZip(exec ExecutableInfo, arch string) error {
-	if !exec.Publish {
-		return nil
+// BuildAllError is returned by RunBuildAll with KeepGoing, with the error of each build that failed.
+type BuildAllError struct {
+	Errors []error
+}
+
+func (e *BuildAllError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
 	}
 
-	outputExec, err := b.GetOutputExecutableName(exec, arch)
+	return fmt.Sprintf("%v builds failed:\n%v", len(e.Errors), strings.Join(msgs, "\n"))
+}
+
+func (b *Builder) RunBuild(exec ExecutableInfo, arch string) error {
+	err := b.validateExecutable(exec, arch)
 	if err != nil {
 		return err
 	}
 
-	_, err = os.Stat(outputExec)
+	err = b.validateAndroidCC(arch)
 	if err != nil {
-		return errors.Wrapf(err, "error accessing compiled executable %v", outputExec)
+		return err
 	}
 
-	outputZip, err := b.GetOutputZipName(exec, arch)
+	b.warnCgoCrossCompile(arch, exec.GCO)
+
+	cmd, err := b.createBuildCommand(exec, arch, b.Err)
+	if err != nil {
+		return err
+	}
+
+	output, err := b.GetOutputExecutableName(exec, arch)
 	if err != nil {
 		return err
 	}
 
-	_ = os.Remove(outputZip)
+	// With SplitDebug, go build would consider the stripped executable up to date and not recreate it
+	if b.cfg.RemoveOutputBeforeBuild || exec.SplitDebug {
+		err = os.Remove(output)
+		if err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "error removing old executable %v", output)
+		}
+	}
+
+	stderr, err := b.Console.RunInlineCapturingErr(cmd...)
+	if err != nil {
+		return describeBuildError(err, stderr)
+	}
+
+	// A BuildCommandHook can change the output, so it may not be there
+	if _, err := os.Stat(output); err != nil {
+		return nil
+	}
+
+	if exec.SplitDebug {
+		err = b.splitDebugInfo(exec, arch, output)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = b.addArtifact(output, "executable", exec, arch)
+	return err
+}
+
+// splitDebugInfo moves the debug info of the executable to <output>.debug and adds a debug link to it
+func (b *Builder) splitDebugInfo(exec ExecutableInfo, arch string, output string) error {
+	goos, _ := splitArch(arch)
+	switch goos {
+	case "windows", "darwin", "ios", "plan9", "js", "wasip1":
+		fmt.Fprintf(b.Err, "WARNING: Not splitting debug info of %v: only supported for ELF executables\n", arch)
+		return nil
+	}
+
+	if containsString(exec.LDFlags, "-w") {
+		fmt.Fprintf(b.Err, "WARNING: Not splitting debug info of %v: it was not generated (-w in ldflags)\n", exec.Name)
+		return nil
+	}
+
+	objcopy, err := b.Console.FindExecutable("objcopy")
+	if err != nil {
+		fmt.Fprintf(b.Err, "WARNING: Not splitting debug info: %v\n", err)
+		return nil
+	}
+
+	debug := output + ".debug"
+
+	// The host objcopy may not know the executable format when cross compiling
+	err = b.Console.RunInline(objcopy, "--only-keep-debug", output, debug)
+	if err != nil {
+		_ = os.Remove(debug)
+		fmt.Fprintf(b.Err, "WARNING: Not splitting debug info of %v: %v\n", arch, err)
+		return nil
+	}
+
+	err = b.Console.RunInline("cd "+filepath.Dir(output), objcopy, "--strip-debug",
+		"--add-gnu-debuglink="+filepath.Base(debug), filepath.Base(output))
+	if err != nil {
+		return err
+	}
+
+	_, err = b.addArtifact(debug, "debug", exec, arch)
+	return err
+}
+
+var buildErrorPackageRE = regexp.MustCompile(`(?m)^# (\S+)\s*$`)
+var buildErrorPositionRE = regexp.MustCompile(`(?m)^(\S+\.go):(\d+)(?::\d+)?: (.+)$`)
+
+// describeBuildError adds the first package and file position reported by go build to the error
+func describeBuildError(err error, stderr string) error {
+	pos := buildErrorPositionRE.FindStringSubmatch(stderr)
+	if pos == nil {
+		return err
+	}
+
+	where := fmt.Sprintf("%v:%v", pos[1], pos[2])
+
+	pkg := buildErrorPackageRE.FindStringSubmatch(stderr)
+	if pkg != nil {
+		where = pkg[1] + " (" + where + ")"
+	}
+
+	return errors.Wrapf(err, "build failed in %v: %v", where, pos[3])
+}
+
+// BuildToWriter builds the executable to a temporary file and copies it to w, so it can be written to stdout. The
+// progress is written to Builder.Err, so it does not mix with the executable.
+func (b *Builder) BuildToWriter(exec ExecutableInfo, arch string, w io.Writer) error {
+	err := b.validateExecutable(exec, arch)
+	if err != nil {
+		return err
+	}
+
+	staging, err := b.createTempDir("build-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	output := filepath.Join(staging, exec.Name)
+	if strings.HasPrefix(arch, "windows/") {
+		output += ".exe"
+	}
+
+	cmd, err := b.createBuildCommandWithOutput(exec, arch, output, b.Err)
+	if err != nil {
+		return err
+	}
+
+	console := *b.Console
+	console.Out = b.Err
+
+	stderr, err := console.RunInlineCapturingErr(cmd...)
+	if err != nil {
+		return describeBuildError(err, stderr)
+	}
+
+	f, err := os.Open(output)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// validateExecutable checks that the executable path is a folder with a package go can build for the arch. Each path
+// and arch is only checked once per run.
+func (b *Builder) validateExecutable(exec ExecutableInfo, arch string) error {
+	key := exec.Path + "\x00" + arch
+
+	b.mutex.Lock()
+	err, ok := b.validatedExecutables[key]
+	b.mutex.Unlock()
+
+	if ok {
+		return err
+	}
+
+	err = b.doValidateExecutable(exec, arch)
+
+	b.mutex.Lock()
+	b.validatedExecutables[key] = err
+	b.mutex.Unlock()
+
+	return err
+}
+
+func (b *Builder) doValidateExecutable(exec ExecutableInfo, arch string) error {
+	info, err := os.Stat(exec.Path)
+	if err != nil {
+		return errors.Wrapf(err, "invalid path of executable %v", exec.Name)
+	}
+
+	if !info.IsDir() {
+		return errors.Errorf("invalid path of executable %v: %v is not a folder", exec.Name, exec.Path)
+	}
+
+	cmd := b.createCrossCompileEnv(arch, exec.GCO)
+	cmd = append(cmd, b.goCommand("list", exec.Path)...)
+
+	_, err = b.Console.RunAndReturnOutput(cmd...)
+	if err != nil {
+		return errors.Wrapf(err, "executable %v has no buildable package for %v in %v", exec.Name, arch, exec.Path)
+	}
+
+	return nil
+}
+
+// createBuildCommand returns the command RunBuild executes, after applying BuildCommandHook. Warnings about ignored
+// options are written to warnings.
+func (b *Builder) createBuildCommand(exec ExecutableInfo, arch string, warnings io.Writer) ([]interface{}, error) {
+	output, err := b.GetOutputExecutableName(exec, arch)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.createBuildCommandWithOutput(exec, arch, output, warnings)
+}
+
+func (b *Builder) createBuildCommandWithOutput(exec ExecutableInfo, arch string, output string,
+	warnings io.Writer) ([]interface{}, error) {
+	var cmd []interface{}
+	var err error
+
+	if b.TINYGO != "" {
+		cmd, err = b.createTinyGoBuildCommand(exec, arch, output, warnings)
+	} else {
+		cmd, err = b.createGoBuildCommand(exec, arch, output, warnings)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if b.cfg.BuildCommandHook != nil {
+		args := make([]string, len(cmd))
+		for i, c := range cmd {
+			args[i] = fmt.Sprint(c)
+		}
+
+		args = b.cfg.BuildCommandHook(exec, arch, args)
+
+		cmd = make([]interface{}, len(args))
+		for i, a := range args {
+			cmd[i] = a
+		}
+	}
+
+	return cmd, nil
+}
+
+func (b *Builder) createGoBuildCommand(exec ExecutableInfo, arch string, output string,
+	warnings io.Writer) ([]interface{}, error) {
+	cmd := b.createCrossCompileEnv(arch, exec.GCO)
+
+	cmd = append(cmd, b.goCommand("build")...)
+
+	for _, a := range exec.BuildArgs {
+		cmd = append(cmd, a)
+	}
+
+	if len(exec.LDFlags) > 0 || len(exec.LDFlagsVars) > 0 {
+		var ldflags []string
+		for _, f := range exec.LDFlags {
+			f, err := b.expandLDFlag(f, exec, arch)
+			if err != nil {
+				return nil, err
+			}
+
+			ldflags = append(ldflags, f)
+		}
+		for k, v := range exec.LDFlagsVars {
+			v, err := b.expandLDFlag(v, exec, arch)
+			if err != nil {
+				return nil, err
+			}
+
+			ldflags = append(ldflags, "-X", fmt.Sprintf(`"%v=%v"`, k, v))
+		}
+
+		cmd = append(cmd, "-ldflags", strings.Join(ldflags, " "))
+	}
+
+	if exec.PGOProfile != "" {
+		_, err := os.Stat(exec.PGOProfile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "error accessing PGO profile %v", exec.PGOProfile)
+		}
+
+		switch {
+		case !b.GO_VERSION.LessThan(semver.MustParse("1.21")):
+			cmd = append(cmd, "-pgo="+exec.PGOProfile)
+		case !exec.pgoDetected:
+			// A detected default.pgo is silently ignored, only an explicit profile is worth a warning
+			fmt.Fprintf(warnings, "WARNING: Ignoring PGO profile: go %v does not support it, it needs at least 1.21\n",
+				b.GO_VERSION)
+		}
+	}
+
+	if b.cfg.BuildVCS != "" {
+		if b.GO_VERSION.LessThan(semver.MustParse("1.18")) {
+			fmt.Fprintf(warnings, "WARNING: Ignoring BuildVCS: go %v does not support it, it needs at least 1.18\n",
+				b.GO_VERSION)
+		} else {
+			cmd = append(cmd, "-buildvcs="+b.cfg.BuildVCS)
+		}
+	}
+
+	cmd = append(cmd, "-o", output, exec.Path)
+
+	return cmd, nil
+}
+
+// tinygoTargets maps the go archs that tinygo builds with its own -target instead of GOOS/GOARCH
+var tinygoTargets = map[string]string{
+	"js/wasm":     "wasm",
+	"wasip1/wasm": "wasip1",
+}
+
+func (b *Builder) createTinyGoBuildCommand(exec ExecutableInfo, arch string, output string,
+	warnings io.Writer) ([]interface{}, error) {
+	var cmd []interface{}
+
+	cmd = append(cmd, "cd "+b.Code.BaseDir)
+
+	for _, e := range b.buildEnv {
+		cmd = append(cmd, e)
+	}
+
+	target, ok := tinygoTargets[arch]
+	if !ok {
+		goos, goarch := splitArch(arch)
+		cmd = append(cmd, "GOOS="+goos, "GOARCH="+goarch)
+	}
+
+	if exec.GCO {
+		cmd = append(cmd, "CGO_ENABLED=1")
+	} else {
+		cmd = append(cmd, "CGO_ENABLED=0")
+	}
+
+	cmd = append(cmd, b.TINYGO, "build")
+
+	if target != "" {
+		cmd = append(cmd, "-target="+target)
+	}
+
+	if !b.cfg.PreserveSymbols {
+		cmd = append(cmd, "-no-debug")
+	}
+
+	for i := 0; i < len(exec.BuildArgs); i++ {
+		a := exec.BuildArgs[i]
+
+		if isGoOnlyBuildArg(a) {
+			// -mod can have its value in the next arg
+			if strings.TrimLeft(a, "-") == "mod" {
+				i++
+			}
+			continue
+		}
+
+		cmd = append(cmd, a)
+	}
+
+	// tinygo only supports -X in ldflags
+	if len(exec.LDFlagsVars) > 0 {
+		var ldflags []string
+		for k, v := range exec.LDFlagsVars {
+			v, err := b.expandLDFlag(v, exec, arch)
+			if err != nil {
+				return nil, err
+			}
+
+			ldflags = append(ldflags, "-X", fmt.Sprintf(`"%v=%v"`, k, v))
+		}
+
+		cmd = append(cmd, "-ldflags", strings.Join(ldflags, " "))
+	}
+
+	if exec.PGOProfile != "" && !exec.pgoDetected {
+		fmt.Fprintln(warnings, "WARNING: Ignoring PGO profile: tinygo does not support it")
+	}
+
+	cmd = append(cmd, "-o", output, exec.Path)
+
+	return cmd, nil
+}
+
+// isGoOnlyBuildArg returns true for the go build flags that tinygo does not accept
+func isGoOnlyBuildArg(arg string) bool {
+	name := strings.SplitN(strings.TrimLeft(arg, "-"), "=", 2)[0]
+
+	return strings.HasPrefix(arg, "-") && (name == "trimpath" || name == "buildvcs" || name == "mod")
+}
+
+// goCommand returns the go command line for a subcommand, with the -mod flag if BuilderConfig.ModMode is set and
+// GOEXPERIMENT if BuilderConfig.GoExperiment is set.
+func (b *Builder) goCommand(subcommand string, args ...interface{}) []interface{} {
+	var cmd []interface{}
+
+	if b.cfg.GoExperiment != "" {
+		cmd = append(cmd, "GOEXPERIMENT="+b.cfg.GoExperiment)
+	}
+
+	cmd = append(cmd, b.GO, subcommand)
+
+	if b.cfg.ModMode != "" {
+		cmd = append(cmd, "-mod="+b.cfg.ModMode)
+	}
+
+	return append(cmd, args...)
+}
+
+// Environment variables with the microarchitecture level of each GOARCH
+var microArchEnvVars = map[string]string{
+	"386":      "GO386",
+	"amd64":    "GOAMD64",
+	"arm":      "GOARM",
+	"arm64":    "GOARM64",
+	"mips":     "GOMIPS",
+	"mipsle":   "GOMIPS",
+	"mips64":   "GOMIPS64",
+	"mips64le": "GOMIPS64",
+	"ppc64":    "GOPPC64",
+	"ppc64le":  "GOPPC64",
+	"riscv64":  "GORISCV64",
+	"wasm":     "GOWASM",
+}
+
+// microArch returns the environment variable and the configured microarchitecture level of an arch, or an empty
+// value if none was configured
+func (b *Builder) microArch(arch string) (string, string) {
+	_, goarch := splitArch(arch)
+
+	value, ok := b.cfg.MicroArchs[arch]
+	if !ok {
+		value = b.cfg.MicroArchs[goarch]
+	}
+
+	return microArchEnvVars[goarch], value
+}
+
+// testCommand returns the go test command line used by the test and coverage targets, with TestParallel and
+// TestArgs
+func (b *Builder) testCommand(args ...interface{}) []interface{} {
+	var flags []interface{}
+
+	if b.cfg.TestParallel > 0 {
+		flags = append(flags, "-p", b.cfg.TestParallel)
+	}
+
+	for _, a := range b.cfg.TestArgs {
+		flags = append(flags, a)
+	}
+
+	return b.goCommand("test", append(flags, args...)...)
+}
+
+func (b *Builder) createCrossCompileEnv(arch string, cgo bool) []interface{} {
+	goos, goarch := splitArch(arch)
+
+	var cmd []interface{}
+
+	cmd = append(cmd, "cd "+b.Code.BaseDir)
+
+	for _, e := range b.buildEnv {
+		cmd = append(cmd, e)
+	}
+
+	cmd = append(cmd, "GOOS="+goos, "GOARCH="+goarch)
+
+	if name, value := b.microArch(arch); value != "" {
+		cmd = append(cmd, name+"="+value)
+	}
+
+	if cc := b.androidCC(arch); cc != "" {
+		cmd = append(cmd, "CC="+cc, "CGO_ENABLED=1")
+	} else if !cgo {
+		cmd = append(cmd, "CGO_ENABLED=0")
+	}
+
+	return cmd
+}
+
+// Clang target triples of the NDK for each android GOARCH
+var androidTriples = map[string]string{
+	"386":   "i686-linux-android",
+	"amd64": "x86_64-linux-android",
+	"arm":   "armv7a-linux-androideabi",
+	"arm64": "aarch64-linux-android",
+}
+
+// androidCC returns the NDK clang used to build an android arch with cgo, or "" if it is not an android arch or
+// BuilderConfig.AndroidNDK is not set
+func (b *Builder) androidCC(arch string) string {
+	goos, goarch := splitArch(arch)
+	if goos != "android" || b.androidToolchain == "" {
+		return ""
+	}
+
+	name := fmt.Sprintf("%v%v-clang", androidTriples[goarch], b.androidAPILevel())
+	if b.GO_GOOS == "windows" {
+		name += ".cmd"
+	}
+
+	return filepath.Join(b.androidToolchain, "bin", name)
+}
+
+// validateAndroidCC checks that the NDK has the clang needed for an android arch
+func (b *Builder) validateAndroidCC(arch string) error {
+	cc := b.androidCC(arch)
+	if cc == "" {
+		return nil
+	}
+
+	_, goarch := splitArch(arch)
+	if androidTriples[goarch] == "" {
+		return errors.Errorf("Android NDK does not support %v", arch)
+	}
+
+	_, err := os.Stat(cc)
+	if err != nil {
+		return errors.Wrapf(err, "Android NDK clang for %v not found (API level %v)", arch, b.androidAPILevel())
+	}
+
+	return nil
+}
+
+func (b *Builder) androidAPILevel() int {
+	if b.cfg.AndroidAPILevel == 0 {
+		return 21
+	}
+
+	return b.cfg.AndroidAPILevel
+}
+
+// warnCgoCrossCompile warns when cgo is enabled for an arch that probably needs a C cross compiler that is not
+// configured, once per arch. It does not stop the build.
+func (b *Builder) warnCgoCrossCompile(arch string, cgo bool) {
+	if !cgo || !b.missingCrossCompiler(arch) {
+		return
+	}
+
+	b.mutex.Lock()
+	warned := b.cgoWarnedArchs[arch]
+	b.cgoWarnedArchs[arch] = true
+	b.mutex.Unlock()
+
+	if warned {
+		return
+	}
+
+	fmt.Fprintf(b.Err, "WARNING: cgo is enabled and CC is not set, building for %v will probably fail "+
+		"without a C cross compiler for it\n", arch)
+}
+
+// missingCrossCompiler returns true if building for the arch with cgo probably needs a C cross compiler that is not
+// configured
+func (b *Builder) missingCrossCompiler(arch string) bool {
+	if b.TINYGO != "" {
+		return false
+	}
+
+	goos, goarch := splitArch(arch)
+	if goos == b.GO_GOOS && goarch == b.GO_GOARCH {
+		return false
+	}
+
+	// Xcode clang builds for all darwin archs
+	if goos == "darwin" && b.GO_GOOS == "darwin" {
+		return false
+	}
+
+	if b.androidCC(arch) != "" {
+		return false
+	}
+
+	for _, e := range b.buildEnv {
+		if k, v := splitEnv(e); k == "CC" && v != "" {
+			return false
+		}
+	}
+
+	return os.Getenv("CC") == ""
+}
+
+// RunBuildTest compiles the test binary of a package, without running it.
+func (b *Builder) RunBuildTest(pkg string, arch string) error {
+	b.warnCgoCrossCompile(arch, b.cfg.GCO)
+
+	cmd := b.createCrossCompileEnv(arch, b.cfg.GCO)
+
+	output, err := b.GetOutputTestBinaryName(pkg, arch)
+	if err != nil {
+		return err
+	}
+
+	cmd = append(cmd, b.goCommand("test", "-c")...)
+
+	for _, a := range b.cfg.BuildArgs {
+		cmd = append(cmd, a)
+	}
+
+	cmd = append(cmd, "-o", output, pkg)
+
+	return b.Console.RunInline(cmd...)
+}
+
+// GetOutputTestBinaryName returns the test binary of a package, named by its path relative to its module, with - as
+// separator, as in a-util.test for ./a/util. The root package of a module uses the last part of the module path.
+func (b *Builder) GetOutputTestBinaryName(pkg string, arch string) (string, error) {
+	name := b.testBinaryName(pkg) + ".test"
+	if strings.HasPrefix(arch, "windows/") {
+		name += ".exe"
+	}
+
+	dir, err := b.archDir(arch)
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Abs(filepath.Join(b.Code.BaseDir, "build", dir, name))
+}
+
+func (b *Builder) testBinaryName(pkg string) string {
+	pkg = path.Clean(filepath.ToSlash(pkg))
+
+	module := b.Code.Package
+	for _, m := range b.Code.Modules {
+		if (pkg == m.Path || strings.HasPrefix(pkg, m.Path+"/")) && len(m.Path) > len(module) {
+			module = m.Path
+		}
+	}
+
+	rel := pkg
+	if module != "" && (pkg == module || strings.HasPrefix(pkg, module+"/")) {
+		rel = strings.TrimPrefix(strings.TrimPrefix(pkg, module), "/")
+	}
+	rel = strings.TrimPrefix(rel, "./")
+
+	if rel == "" || rel == "." {
+		if module == "" {
+			return filepath.Base(b.Code.BaseDir)
+		}
+		return path.Base(module)
+	}
+
+	return strings.ReplaceAll(rel, "/", "-")
+}
+
+// RunAssetBuild runs the command of an asset build and checks that it created its output.
+func (b *Builder) RunAssetBuild(ab AssetBuild) error {
+	cmd := make([]interface{}, len(ab.Run))
+	for i, a := range ab.Run {
+		cmd[i] = a
+	}
+
+	err := b.Console.RunInline(cmd...)
+	if err != nil {
+		return err
+	}
+
+	output := filepath.Join(b.Code.BaseDir, ab.Output)
+
+	info, err := os.Stat(output)
+	if err != nil {
+		return errors.Wrapf(err, "asset build %v did not create %v", ab.Name, ab.Output)
+	}
+
+	if info.IsDir() {
+		entries, err := os.ReadDir(output)
+		if err != nil {
+			return err
+		}
+
+		if len(entries) == 0 {
+			return errors.Errorf("asset build %v created an empty folder: %v", ab.Name, ab.Output)
+		}
+	}
+
+	return nil
+}
+
+// RunGenerateBuildInfo creates buildinfo_gen.go with constants containing the build information. The file is kept
+// after the build, so the code using it compiles outside the builder too.
+func (b *Builder) RunGenerateBuildInfo() error {
+	dir := filepath.Join(b.Code.BaseDir, b.cfg.BuildInfoPackageDir)
+
+	pkg, err := findPackageName(dir)
+	if err != nil {
+		return err
+	}
+
+	var sb strings.Builder
+	sb.WriteString("// Code generated by go-build. DO NOT EDIT.\n")
+	sb.WriteString("\n")
+	sb.WriteString("package " + pkg + "\n")
+	sb.WriteString("\n")
+	sb.WriteString("const (\n")
+	sb.WriteString(fmt.Sprintf("\tVersion   = %q\n", b.Code.Version.String()))
+	sb.WriteString(fmt.Sprintf("\tCommit    = %q\n", b.Git.Commit))
+	sb.WriteString(fmt.Sprintf("\tBuildDate = %q\n", b.Code.BuildDate.String()))
+	sb.WriteString(")\n")
+
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(filepath.Join(dir, "buildinfo_gen.go"), []byte(sb.String()))
+}
+
+func findPackageName(dir string) (string, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".go") || strings.HasSuffix(name, "_test.go") ||
+			name == "buildinfo_gen.go" {
+			continue
+		}
+
+		f, err := parser.ParseFile(token.NewFileSet(), filepath.Join(dir, name), nil, parser.PackageClauseOnly)
+		if err != nil {
+			return "", err
+		}
+
+		return f.Name.Name, nil
+	}
+
+	return filepath.Base(dir), nil
+}
+
+// RunCodeSign signs windows executables with Authenticode. It uses signtool when running on windows and
+// osslsigncode otherwise.
+func (b *Builder) RunCodeSign(exec ExecutableInfo, arch string) error {
+	if !strings.HasPrefix(arch, "windows/") {
+		return nil
+	}
+
+	cfg := b.cfg.WindowsSign
+	if cfg.CertFile == "" {
+		fmt.Fprintln(b.Out, "Skipping code signing: no certificate configured")
+		return nil
+	}
+
+	output, err := b.GetOutputExecutableName(exec, arch)
+	if err != nil {
+		return err
+	}
+
+	if b.GO_GOOS == "windows" {
+		signtool, err := b.Console.FindExecutable("signtool")
+		if err != nil {
+			return err
+		}
+
+		cmd := []interface{}{signtool, "sign", "/f", cfg.CertFile, "/fd", "sha256"}
+		if cfg.CertPassword != "" {
+			cmd = append(cmd, "/p", cfg.CertPassword)
+		}
+		if cfg.TimestampURL != "" {
+			cmd = append(cmd, "/tr", cfg.TimestampURL, "/td", "sha256")
+		}
+		cmd = append(cmd, output)
+
+		return b.Console.RunInline(cmd...)
+	}
+
+	osslsigncode, err := b.Console.FindExecutable("osslsigncode")
+	if err != nil {
+		return err
+	}
+
+	signed := output + ".signed"
+	_ = os.Remove(signed)
+
+	cmd := []interface{}{osslsigncode, "sign", "-pkcs12", cfg.CertFile, "-h", "sha256"}
+	if cfg.CertPassword != "" {
+		cmd = append(cmd, "-pass", cfg.CertPassword)
+	}
+	if cfg.TimestampURL != "" {
+		cmd = append(cmd, "-ts", cfg.TimestampURL)
+	}
+	cmd = append(cmd, "-in", output, "-out", signed)
+
+	err = b.Console.RunInline(cmd...)
+	if err != nil {
+		_ = os.Remove(signed)
+		return err
+	}
+
+	return os.Rename(signed, output)
+}
+
+// RunMacSign signs darwin executables with codesign and, if configured, notarizes them with notarytool. Plain
+// executables can't be stapled, so Gatekeeper checks the notarization online.
+func (b *Builder) RunMacSign(exec ExecutableInfo, arch string) error {
+	if !strings.HasPrefix(arch, "darwin/") {
+		return nil
+	}
+
+	cfg := b.cfg.MacSign
+	if cfg.Identity == "" {
+		fmt.Fprintln(b.Out, "Skipping macOS signing: no identity configured")
+		return nil
+	}
+
+	if b.GO_GOOS != "darwin" {
+		fmt.Fprintln(b.Err, "WARNING: Skipping macOS signing: codesign is only available on macOS")
+		return nil
+	}
+
+	codesign, err := b.Console.FindExecutable("codesign")
+	if err != nil {
+		return err
+	}
+
+	output, err := b.GetOutputExecutableName(exec, arch)
+	if err != nil {
+		return err
+	}
+
+	err = b.Console.RunInline(codesign, "--force", "--options", "runtime", "--timestamp", "--sign", cfg.Identity, output)
+	if err != nil {
+		return err
+	}
+
+	if !cfg.Notarize {
+		return nil
+	}
+
+	xcrun, err := b.Console.FindExecutable("xcrun")
+	if err != nil {
+		return err
+	}
+
+	staging, err := b.createTempDir("notarize-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(staging)
+
+	// notarytool only accepts zip, pkg or dmg files
+	notarizeZip := filepath.Join(staging, filepath.Base(output)+".zip")
+
+	err = b.writeZip(notarizeZip, output)
+	if err != nil {
+		return err
+	}
+
+	cmd := []interface{}{xcrun, "notarytool", "submit", notarizeZip, "--wait"}
+	if cfg.KeychainProfile != "" {
+		cmd = append(cmd, "--keychain-profile", cfg.KeychainProfile)
+	} else {
+		cmd = append(cmd,
+			"--apple-id", firstNonEmpty(cfg.AppleID, os.Getenv("APPLE_ID")),
+			"--team-id", firstNonEmpty(cfg.TeamID, os.Getenv("APPLE_TEAM_ID")),
+			"--password", firstNonEmpty(cfg.Password, os.Getenv("APPLE_PASSWORD")))
+	}
+
+	return b.Console.RunInline(cmd...)
+}
+
+var gitDescribeSuffixRE = regexp.MustCompile(`(^|-)(\d+-g[0-9a-f]+|dirty)$`)
+
+// RunTag creates an annotated git tag v<version>, or <TagPrefix><version>, at HEAD and, if BuilderConfig.PushTags is
+// set, pushes it.
+func (b *Builder) RunTag() error {
+	if b.GIT == "" {
+		return errors.New("git is needed to create the tag")
+	}
+
+	if b.IsDevelVersion() || gitDescribeSuffixRE.MatchString(b.Code.Version.Prerelease()) {
+		return errors.Errorf("not a release version: %v", b.Code.Version)
+	}
+
+	status, err := b.Console.RunAndReturnOutput(b.GIT, "status", "--porcelain")
+	if err != nil {
+		return err
+	}
+	if status != "" {
+		return errors.New("can't create tag: there are uncommitted changes")
+	}
+
+	tag := b.gitTagName(b.Code.Version)
+
+	_, err = b.Console.RunAndReturnOutput(b.GIT, "rev-parse", "-q", "--verify", "refs/tags/"+tag)
+	if err == nil {
+		return errors.Errorf("tag already exists: %v", tag)
+	}
+
+	err = b.Console.RunInline(b.GIT, "tag", "-a", tag, "-m", tag)
+	if err != nil {
+		return err
+	}
+
+	if !b.cfg.PushTags {
+		return nil
+	}
+
+	return b.Console.RunInline(b.GIT, "push", "--follow-tags")
+}
+
+// RunChangelog writes build/CHANGELOG-<version>.md with the subjects of the commits since the previous tag, or of
+// all commits if there is no previous tag.
+func (b *Builder) RunChangelog() error {
+	if b.GIT == "" {
+		return errors.New("git is needed to create the changelog")
+	}
+
+	// If HEAD is tagged, the previous tag is the one before it
+	from := "HEAD"
+	_, err := b.Console.RunAndReturnOutput(b.gitDescribe("--exact-match", "HEAD")...)
+	if err == nil {
+		from = "HEAD^"
+	}
+
+	rev := "HEAD"
+	prevTag, err := b.Console.RunAndReturnOutput(b.gitDescribe("--abbrev=0", from)...)
+	if err == nil && prevTag != "" {
+		rev = prevTag + "..HEAD"
+	}
+
+	log, err := b.Console.RunAndReturnOutput(b.GIT, "log", rev, "--pretty=%s")
+	if err != nil {
+		return err
+	}
+
+	var subjects []string
+	for _, l := range strings.Split(log, "\n") {
+		l = strings.TrimSpace(l)
+		if l != "" {
+			subjects = append(subjects, l)
+		}
+	}
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("# %v\n\n", b.Code.Version))
+
+	if b.cfg.ChangelogGroupByType {
+		writeChangelogGroups(&sb, subjects)
+	} else {
+		for _, s := range subjects {
+			sb.WriteString("- " + s + "\n")
+		}
+	}
+
+	name := fixFilename(fmt.Sprintf("CHANGELOG-%v.md", b.Code.Version))
+	output := filepath.Join(b.Code.BaseDir, "build", name)
+
+	err = os.MkdirAll(filepath.Dir(output), 0o755)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(output, []byte(sb.String()))
+}
+
+var conventionalCommitRE = regexp.MustCompile(`^(\w+)(\([^)]*\))?!?:\s*(.*)$`)
+
+var changelogGroupTitles = map[string]string{
+	"feat":     "Features",
+	"fix":      "Bug Fixes",
+	"perf":     "Performance",
+	"refactor": "Refactoring",
+	"docs":     "Documentation",
+	"test":     "Tests",
+	"build":    "Build",
+	"ci":       "CI",
+	"chore":    "Chores",
+}
+
+func writeChangelogGroups(sb *strings.Builder, subjects []string) {
+	groups := map[string][]string{}
+	var order []string
+
+	for _, s := range subjects {
+		group := "Other"
+		text := s
+
+		parts := conventionalCommitRE.FindStringSubmatch(s)
+		if parts != nil {
+			title, ok := changelogGroupTitles[strings.ToLower(parts[1])]
+			if ok {
+				group = title
+				text = parts[3]
+			}
+		}
+
+		if _, ok := groups[group]; !ok {
+			order = append(order, group)
+		}
+		groups[group] = append(groups[group], text)
+	}
+
+	// Features and fixes first, other at the end
+	rank := func(g string) int {
+		switch g {
+		case "Features":
+			return 0
+		case "Bug Fixes":
+			return 1
+		case "Other":
+			return 3
+		default:
+			return 2
+		}
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return rank(order[i]) < rank(order[j])
+	})
+
+	for _, g := range order {
+		sb.WriteString("## " + g + "\n\n")
+		for _, s := range groups[g] {
+			sb.WriteString("- " + s + "\n")
+		}
+		sb.WriteString("\n")
+	}
+}
+
+// RunCleanZip removes the zips of the executables for the current version, and their hash files, listing them. Other
+// zip files in the build folder are kept. With BuilderConfig.DryRun, they are only listed.
+func (b *Builder) RunCleanZip() error {
+	files, err := b.findZipsToClean()
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		if b.cfg.DryRun {
+			fmt.Fprintf(b.Out, "Would remove %v\n", file)
+			continue
+		}
+
+		fmt.Fprintf(b.Out, "Removing %v\n", file)
+
+		err = os.Remove(file)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findZipsToClean returns the files in the build folder named as the zips created by RunZip:
+// <executable>-<version>-*.zip, and their hash files in build/.cache
+func (b *Builder) findZipsToClean() ([]string, error) {
+	buildDir, err := filepath.Abs(filepath.Join(b.Code.BaseDir, "build"))
+	if err != nil {
+		return nil, err
+	}
+
+	var prefixes []string
+	for _, e := range b.Executables {
+		prefixes = append(prefixes, fixFilename(fmt.Sprintf("%v-%v-", e.Name, b.Code.Version)))
+	}
+
+	ext := b.archiveExtension()
+
+	var result []string
+	for dir, suffix := range map[string]string{
+		buildDir:                          ext,
+		filepath.Join(buildDir, ".cache"): ext + zipHashSuffix,
+	} {
+		files, err := os.ReadDir(dir)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		for _, file := range files {
+			if file.IsDir() || !strings.HasSuffix(file.Name(), suffix) {
+				continue
+			}
+
+			for _, p := range prefixes {
+				if strings.HasPrefix(file.Name(), p) {
+					result = append(result, filepath.Join(dir, file.Name()))
+					break
+				}
+			}
+		}
+	}
+
+	sort.Strings(result)
+
+	return result, nil
+}
+
+func (b *Builder) RunZip(exec ExecutableInfo, arch string) error {
+	if !exec.Publish {
+		return nil
+	}
+
+	outputExec, err := b.GetOutputExecutableName(exec, arch)
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(outputExec)
+	if err != nil {
+		return errors.Wrapf(err, "error accessing compiled executable %v", outputExec)
+	}
+
+	outputZip, err := b.GetOutputZipName(exec, arch)
+	if err != nil {
+		return err
+	}
+
+	var extra []zipExtraFile
+	if b.cfg.ZipBuildInfo {
+		info, err := b.createZipBuildInfo(exec, arch)
+		if err != nil {
+			return err
+		}
+
+		extra = append(extra, info)
+	}
+
+	sourcesHash, err := b.hashZipSources(outputExec, extra)
+	if err != nil {
+		return err
+	}
+
+	hashFile := getZipHashFileName(outputZip)
+
+	oldHash, err := os.ReadFile(hashFile)
+	_, zerr := os.Stat(outputZip)
+	if err == nil && zerr == nil && string(oldHash) == sourcesHash {
+		fmt.Fprintf(b.Out, "Zip is up to date: %v\n", outputZip)
+
+	} else {
+		_ = os.Remove(outputZip)
+		_ = os.Remove(hashFile)
+
+		err = b.writeArchive(outputZip, outputExec, extra...)
+		if err != nil {
+			return err
+		}
+
+		err = os.MkdirAll(filepath.Dir(hashFile), 0o755)
+		if err != nil {
+			return err
+		}
+
+		err = writeFileAtomic(hashFile, []byte(sourcesHash))
+		if err != nil {
+			return err
+		}
+	}
+
+	artifact, err := b.addArtifact(outputZip, "zip", exec, arch)
+	if err != nil {
+		return err
+	}
+
+	err = b.zipDebugInfo(exec, arch, outputExec)
+	if err != nil {
+		return err
+	}
+
+	if b.cfg.CleanBinariesAfterZip {
+		b.addZippedBinary(outputExec)
+	}
+
+	if b.cfg.OnArtifact != nil {
+		err = b.cfg.OnArtifact(artifact)
+		if err != nil {
+			return errors.Wrapf(err, "error processing %v", outputZip)
+		}
+	}
+
+	return nil
+}
+
+// removeZippedBinaries removes the executables added to zips in this run, for CleanBinariesAfterZip. It runs after
+// all the targets, so targets that run after the zips, like image and smoke, still find the executables.
+func (b *Builder) removeZippedBinaries() error {
+	b.mutex.Lock()
+	files := b.zippedBinaries
+	b.zippedBinaries = nil
+	b.mutex.Unlock()
+
+	for _, file := range files {
+		if b.cfg.DryRun {
+			fmt.Fprintf(b.Out, "Would remove %v\n", file)
+			continue
+		}
+
+		err := os.Remove(file)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		b.removeArtifact(file)
+	}
+
+	return nil
+}
+
+// writeArchive writes the file and the extra files to a zip or tar.zst, depending on BuilderConfig.ArchiveFormat
+func (b *Builder) writeArchive(output string, file string, extra ...zipExtraFile) error {
+	if b.cfg.ArchiveFormat == "tar.zst" {
+		return b.writeTarZst(output, file, extra...)
+	}
+
+	return b.writeZip(output, file, extra...)
+}
+
+// zipDebugInfo archives the debug info created by ExecutableInfo.SplitDebug, if there is one, separately from the
+// executable. It is registered as a debug-zip artifact, so it can be kept without being published.
+func (b *Builder) zipDebugInfo(exec ExecutableInfo, arch string, outputExec string) error {
+	if !exec.SplitDebug {
+		return nil
+	}
+
+	debug := outputExec + ".debug"
+	debugInfo, err := os.Stat(debug)
+	if err != nil {
+		return nil
+	}
+
+	output, err := b.GetOutputDebugZipName(exec, arch)
+	if err != nil {
+		return err
+	}
+
+	if outputInfo, err := os.Stat(output); err == nil && !outputInfo.ModTime().Before(debugInfo.ModTime()) {
+		fmt.Fprintf(b.Out, "Zip is up to date: %v\n", output)
+
+	} else {
+		err = b.writeArchive(output, debug)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = b.addArtifact(output, "debug-zip", exec, arch)
+	return err
+}
+
+// Suffix of the file, in build/.cache, with the hash of what was zipped. It is used to only recreate the zips that
+// changed.
+const zipHashSuffix = ".src-sha256"
+
+// getZipHashFileName returns the file with the hash of what was zipped in outputZip. It is kept in the .cache folder,
+// so it is not mixed with the artifacts.
+func getZipHashFileName(outputZip string) string {
+	return filepath.Join(filepath.Dir(outputZip), ".cache", filepath.Base(outputZip)+zipHashSuffix)
+}
+
+// hashZipSources returns a hash of everything that changes the contents of the zip
+func (b *Builder) hashZipSources(outputExec string, extra []zipExtraFile) (string, error) {
+	f, err := os.Open(outputExec)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	hash := sha256.New()
+
+	_, err = io.Copy(hash, f)
+	if err != nil {
+		return "", err
+	}
+
+	fmt.Fprintf(hash, "\x00%v\x00%v\x00%v\x00%v", filepath.Base(outputExec), b.Code.BuildDate.UTC(),
+		b.cfg.CompressionLevel, b.cfg.ZstdLevel)
+
+	for _, e := range extra {
+		fmt.Fprintf(hash, "\x00%v\x00", e.Name)
+		hash.Write(e.Data)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+type zipExtraFile struct {
+	Name string
+	Data []byte
+}
+
+func (b *Builder) writeZip(outputZip string, outputExec string, extra ...zipExtraFile) error {
+	return createFileAtomic(outputZip, func(w io.Writer) error {
+		return b.writeZipTo(w, outputExec, extra...)
+	})
+}
+
+// writeTarZst creates a tar with the executable, compressed with zstd
+func (b *Builder) writeTarZst(output string, outputExec string, extra ...zipExtraFile) error {
+	var opts []zstd.EOption
+	if b.cfg.ZstdLevel > 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(b.cfg.ZstdLevel)))
+	}
+
+	return createFileAtomic(output, func(w io.Writer) error {
+		zw, err := zstd.NewWriter(w, opts...)
+		if err != nil {
+			return err
+		}
+
+		err = b.writeTarTo(zw, outputExec, extra...)
+		if err != nil {
+			_ = zw.Close()
+			return err
+		}
+
+		return zw.Close()
+	})
+}
+
+func (b *Builder) writeTarTo(w io.Writer, outputExec string, extra ...zipExtraFile) error {
+	oe, err := os.Open(outputExec)
+	if err != nil {
+		return err
+	}
+	defer oe.Close()
+
+	stat, err := oe.Stat()
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+
+	// Use a fixed time so the same executable always creates the same tar
+	err = tw.WriteHeader(&tar.Header{
+		Name:    filepath.Base(outputExec),
+		Mode:    0o755,
+		Size:    stat.Size(),
+		ModTime: b.Code.BuildDate.UTC(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, oe)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range extra {
+		err = tw.WriteHeader(&tar.Header{
+			Name:    e.Name,
+			Mode:    0o644,
+			Size:    int64(len(e.Data)),
+			ModTime: b.Code.BuildDate.UTC(),
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tw.Write(e.Data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+func (b *Builder) writeZipTo(w io.Writer, outputExec string, extra ...zipExtraFile) error {
+	oe, err := os.Open(outputExec)
+	if err != nil {
+		return err
+	}
+	defer oe.Close()
+
+	zw := zip.NewWriter(w)
+
+	// Use a fixed time so the same executable always creates the same zip
+	header := &zip.FileHeader{
+		Name:     filepath.Base(outputExec),
+		Method:   zip.Deflate,
+		Modified: b.Code.BuildDate.UTC(),
+	}
+
+	switch level := b.cfg.CompressionLevel; {
+	case level == CompressionStore:
+		header.Method = zip.Store
+	case level > 0:
+		zw.RegisterCompressor(zip.Deflate, func(w io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(w, level)
+		})
+	}
+
+	ze, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(ze, oe)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range extra {
+		eh := *header
+		eh.Name = e.Name
+
+		ze, err = zw.CreateHeader(&eh)
+		if err != nil {
+			return err
+		}
+
+		_, err = ze.Write(e.Data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+type zipBuildInfo struct {
+	Name      string `json:"name"`
+	Version   string `json:"version"`
+	Commit    string `json:"commit,omitempty"`
+	BuildDate string `json:"buildDate"`
+	OS        string `json:"os"`
+	Arch      string `json:"arch"`
+	GoVersion string `json:"goVersion"`
+}
+
+func (b *Builder) createZipBuildInfo(exec ExecutableInfo, arch string) (zipExtraFile, error) {
+	goos, goarch := splitArch(arch)
+
+	info := zipBuildInfo{
+		Name:      exec.Name,
+		Version:   b.Code.Version.String(),
+		Commit:    b.Git.Commit,
+		BuildDate: b.Code.BuildDate.UTC().Format(time.RFC3339),
+		OS:        goos,
+		Arch:      goarch,
+		GoVersion: b.GO_VERSION.String(),
+	}
+
+	data, err := json.MarshalIndent(info, "", "  ")
+	if err != nil {
+		return zipExtraFile{}, err
+	}
+
+	return zipExtraFile{
+		Name: "build-info.json",
+		Data: data,
+	}, nil
+}
+
+// archiveExtension returns the extension of the files created by the zip targets
+func (b *Builder) archiveExtension() string {
+	if b.cfg.ArchiveFormat == "tar.zst" {
+		return ".tar.zst"
+	}
+
+	return ".zip"
+}
+
+func (b *Builder) GetOutputZipName(exec ExecutableInfo, arch string) (string, error) {
+	archName := strings.ReplaceAll(arch, "/", "_")
+	if _, value := b.microArch(arch); value != "" {
+		if value[0] >= '0' && value[0] <= '9' {
+			value = "v" + value
+		}
+		archName += "_" + value
+	}
+
+	name := fmt.Sprintf("%v-%v-%v%v", exec.Name, b.Code.Version, archName, b.archiveExtension())
+	name = fixFilename(name)
+
+	output, err := filepath.Abs(filepath.Join(b.Code.BaseDir, "build", name))
+	if err != nil {
+		return "", err
+	}
+
+	return output, nil
+}
+
+// GetOutputDebugZipName returns the archive with the debug info split by ExecutableInfo.SplitDebug. It is named as
+// the zip of the executable, with -debug before the extension.
+func (b *Builder) GetOutputDebugZipName(exec ExecutableInfo, arch string) (string, error) {
+	output, err := b.GetOutputZipName(exec, arch)
+	if err != nil {
+		return "", err
+	}
+
+	ext := b.archiveExtension()
+
+	return strings.TrimSuffix(output, ext) + "-debug" + ext, nil
+}
+
+func (b *Builder) GetOutputExecutableName(exec ExecutableInfo, arch string) (string, error) {
+	name := exec.Name
+	if exec.BinaryNameTemplate != "" {
+		var err error
+		name, err = b.executeBinaryNameTemplate(exec, arch)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	archDir, err := b.archDir(arch)
+	if err != nil {
+		return "", err
+	}
+
+	dir := filepath.Join(b.Code.BaseDir, "build", archDir)
+
+	flat := b.cfg.FlatOutput || len(exec.Archs) == 1
+
+	switch {
+	case b.cfg.IncludeArchInBinaryName || (flat && len(exec.Archs) > 1):
+		name += "-" + strings.ReplaceAll(arch, "/", "-")
+		dir = filepath.Join(b.Code.BaseDir, "build")
+	case flat:
+		dir = filepath.Join(b.Code.BaseDir, "build")
+	}
+
+	if strings.HasPrefix(arch, "windows/") {
+		name += ".exe"
+	}
+
+	output, err := filepath.Abs(filepath.Join(dir, name))
+	if err != nil {
+		return "", err
+	}
+
+	return output, nil
+}
+
+// RunSmokeTest runs the host executable with ExecutableInfo.SmokeArgs, failing if it does not exit with 0.
+func (b *Builder) RunSmokeTest(exec ExecutableInfo) error {
+	arch := b.GO_GOOS + "/" + b.GO_GOARCH
+
+	output, err := b.GetOutputExecutableName(exec, arch)
+	if err != nil {
+		return err
+	}
+
+	cmd := []interface{}{output}
+	for _, a := range exec.SmokeArgs {
+		cmd = append(cmd, a)
+	}
+
+	err = b.Console.RunInline(cmd...)
+	if err != nil {
+		return errors.Wrapf(err, "smoke test of %v failed", exec.Name)
+	}
+
+	return nil
+}
 
-	oz, err := os.Create(outputZip)
-	if err != nil {
-		return err
+// archDir returns the folder, inside build, of the executables of an arch, using BuilderConfig.ArchDirFormat
+func (b *Builder) archDir(arch string) (string, error) {
+	if b.cfg.ArchDirFormat == "" {
+		return filepath.FromSlash(arch), nil
 	}
-	defer oz.Close()
 
-	oe, err := os.Open(outputExec)
+	tmpl, err := template.New("archDir").Parse(b.cfg.ArchDirFormat)
 	if err != nil {
-		return err
+		return "", errors.Wrapf(err, "invalid arch dir format")
 	}
-	defer oe.Close()
 
-	zw := zip.NewWriter(oz)
-	defer zw.Close()
+	goos, goarch := splitArch(arch)
 
-	ze, err := zw.Create(filepath.Base(outputExec))
+	var result strings.Builder
+	err = tmpl.Execute(&result, map[string]string{
+		"OS":   goos,
+		"Arch": goarch,
+	})
 	if err != nil {
-		return err
+		return "", errors.Wrapf(err, "error creating the folder of %v", arch)
 	}
 
-	_, err = io.Copy(ze, oe)
-	if err != nil {
-		return err
+	dir := filepath.Clean(filepath.FromSlash(result.String()))
+	if dir == "." || filepath.IsAbs(dir) || strings.HasPrefix(dir, "..") {
+		return "", errors.Errorf("arch dir format must create a relative folder inside build: %v", dir)
 	}
 
-	return nil
+	return dir, nil
 }
 
-func (b *Builder) GetOutputZipName(exec ExecutableInfo, arch string) (string, error) {
-	name := fmt.Sprintf("%v-%v-%v.zip", exec.Name, b.Code.Version, strings.ReplaceAll(arch, "/", "_"))
-	name = fixFilename(name)
+// templateData returns the fields available in the templates of an executable
+func (b *Builder) templateData(exec ExecutableInfo, arch string) map[string]string {
+	goos, goarch := splitArch(arch)
+
+	return map[string]string{
+		"Name":      exec.Name,
+		"Version":   b.Code.Version.String(),
+		"Commit":    b.Git.Commit,
+		"BuildDate": b.Code.BuildDate.UTC().Format(time.RFC3339),
+		"OS":        goos,
+		"Arch":      goarch,
+	}
+}
 
-	output, err := filepath.Abs(filepath.Join(b.Code.BaseDir, "build", name))
+// expandLDFlag executes the text/template in an ldflag or ldflag var value. Text without {{ is returned unchanged.
+func (b *Builder) expandLDFlag(text string, exec ExecutableInfo, arch string) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	tmpl, err := template.New("ldflag").Parse(text)
 	if err != nil {
-		return "", err
+		return "", errors.Wrapf(err, "invalid ldflag template of %v: %v", exec.Name, text)
 	}
 
-	return output, nil
+	var result strings.Builder
+	err = tmpl.Execute(&result, b.templateData(exec, arch))
+	if err != nil {
+		return "", errors.Wrapf(err, "error expanding ldflag of %v: %v", exec.Name, text)
+	}
+
+	return result.String(), nil
 }
 
-func (b *Builder) GetOutputExecutableName(exec ExecutableInfo, arch string) (string, error) {
-	name := exec.Name
-	if strings.HasPrefix(arch, "windows/") {
-		name += ".exe"
+func (b *Builder) executeBinaryNameTemplate(exec ExecutableInfo, arch string) (string, error) {
+	tmpl, err := template.New("binary").Parse(exec.BinaryNameTemplate)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid binary name template for %v", exec.Name)
 	}
 
-	output, err := filepath.Abs(filepath.Join(b.Code.BaseDir, "build", arch, name))
+	var result strings.Builder
+	err = tmpl.Execute(&result, b.templateData(exec, arch))
 	if err != nil {
-		return "", err
+		return "", errors.Wrapf(err, "error creating the binary name of %v", exec.Name)
 	}
 
-	return output, nil
+	name := fixFilename(result.String())
+	if name == "" {
+		return "", errors.Errorf("binary name template created an empty name for %v", exec.Name)
+	}
+
+	return name, nil
 }
 
 func (b *Builder) RunLicenseCheck() error {
 	if b.Code.License == "" {
-		fmt.Println("Can't run license check: unknown code license")
+		fmt.Fprintln(b.Out, "Can't run license check: unknown code license")
 		return nil
 	}
 
@@ -202,6 +2214,13 @@ func (b *Builder) RunLicenseCheck() error {
 		return err
 	}
 
+	if b.cfg.LicenseCheck.VerifySums {
+		err = b.verifyModuleSums(deps)
+		if err != nil {
+			return err
+		}
+	}
+
 	for _, dep := range deps {
 		err = b.fillLicenseInfo(dep, modCacheRoot)
 		if err != nil {
@@ -213,12 +2232,12 @@ func (b *Builder) RunLicenseCheck() error {
 		return deps[i].Path < deps[j].Path
 	})
 
-	output := termenv.NewOutput(os.Stdout)
+	output := b.newColorOutput(b.Out)
 	withColor := func(text, color string) fmt.Stringer {
 		return output.String(text).Foreground(output.Color(color))
 	}
 
-	fmt.Printf("License: %v\n", withColor(b.Code.License, "2"))
+	fmt.Fprintf(b.Out, "License: %v\n", withColor(b.Code.License, "2"))
 
 	incompatible := 0
 
@@ -270,11 +2289,16 @@ func (b *Builder) RunLicenseCheck() error {
 			result = "unknown"
 		}
 
-		fmt.Printf("%v %v %v : %v : %v\n",
+		fmt.Fprintf(b.Out, "%v %v %v : %v : %v\n",
 			withColor(p, color), dep.Path, dep.Version, withColor(license, color), result)
 	}
 
-	fmt.Println("This is not legal advice. For general information only. Based on https://dwheeler.com/essays/floss-license-slide.html")
+	fmt.Fprintln(b.Out, "This is not legal advice. For general information only. Based on https://dwheeler.com/essays/floss-license-slide.html")
+
+	err = b.writeThirdPartyNotices(deps)
+	if err != nil {
+		return err
+	}
 
 	if incompatible > 0 {
 		return errors.Errorf("%v dependencies with incompatible licenses", incompatible)
@@ -283,19 +2307,214 @@ func (b *Builder) RunLicenseCheck() error {
 	return nil
 }
 
+// GetOutputNoticesName returns the file with the NOTICE files of the dependencies, written by the license check.
+func (b *Builder) GetOutputNoticesName() (string, error) {
+	return filepath.Abs(filepath.Join(b.Code.BaseDir, "build", "THIRD_PARTY_NOTICES.txt"))
+}
+
+// writeThirdPartyNotices writes the NOTICE files of the dependencies, that must be distributed with the executables,
+// to GetOutputNoticesName. Nothing is written if no dependency has them.
+func (b *Builder) writeThirdPartyNotices(deps []*modDependency) error {
+	var text strings.Builder
+	for _, dep := range deps {
+		for _, notice := range dep.Notices {
+			fmt.Fprintf(&text, "%v %v\n\n%v\n\n", dep.Path, dep.Version, strings.TrimSpace(notice))
+		}
+	}
+
+	if text.Len() == 0 {
+		return nil
+	}
+
+	output, err := b.GetOutputNoticesName()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(output), 0o755)
+	if err != nil {
+		return err
+	}
+
+	err = writeFileAtomic(output, []byte(text.String()))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(b.Out, "Dependency NOTICE files written to %v\n", output)
+
+	_, err = b.addArtifact(output, "notices", ExecutableInfo{}, "")
+	return err
+}
+
+// startLogFile truncates BuilderConfig.LogFile and makes the output also go to it. The returned func restores the
+// output and closes the file.
+func (b *Builder) startLogFile() (func(), error) {
+	path := b.cfg.LogFile
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(b.Code.BaseDir, path)
+	}
+
+	err := os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return nil, err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "error creating log file")
+	}
+
+	out, errOut := b.Out, b.Err
+	b.SetOutput(io.MultiWriter(out, f), io.MultiWriter(errOut, f))
+
+	return func() {
+		b.SetOutput(out, errOut)
+		_ = f.Close()
+	}, nil
+}
+
+func (b *Builder) newColorOutput(w io.Writer) *termenv.Output {
+	switch b.cfg.Color {
+	case "always":
+		return termenv.NewOutput(w, termenv.WithProfile(termenv.ANSI))
+	case "never":
+		return termenv.NewOutput(w, termenv.WithProfile(termenv.Ascii))
+	default:
+		return termenv.NewOutput(w)
+	}
+}
+
+type GoCacheInfo struct {
+	Dir  string
+	Size int64
+}
+
+// GoCache returns the go build cache folder and its current size.
+func (b *Builder) GoCache() (*GoCacheInfo, error) {
+	dir, err := b.Console.RunAndReturnOutput(b.GO, "env", "GOCACHE")
+	if err != nil {
+		return nil, err
+	}
+
+	result := &GoCacheInfo{
+		Dir: dir,
+	}
+
+	if dir == "" || dir == "off" {
+		return result, nil
+	}
+
+	err = filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+
+		if entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+
+		result.Size += info.Size()
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (b *Builder) RunGoCacheInfo() error {
+	cache, err := b.GoCache()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(b.Out, "GOCACHE: %v\n", cache.Dir)
+	fmt.Fprintf(b.Out, "Size: %v\n", formatSize(cache.Size))
+
+	return nil
+}
+
 func (b *Builder) loadModCacheRoot() (string, error) {
 	root, err := b.Console.RunAndReturnOutput(b.GO, "env", "GOMODCACHE")
 	if err != nil {
 		return "", err
 	}
 
-	root = addSeparatorAtEnd(root)
+	// GOMODCACHE only exists since go 1.15, before it was always inside the first GOPATH entry
+	if root == "" {
+		gopath, err := b.Console.RunAndReturnOutput(b.GO, "env", "GOPATH")
+		if err != nil {
+			return "", err
+		}
+
+		gopath = strings.Split(gopath, string(filepath.ListSeparator))[0]
+		if gopath == "" {
+			return "", errors.New("unable to find the go module cache: GOMODCACHE and GOPATH are empty")
+		}
+
+		root = filepath.Join(gopath, "pkg", "mod")
+	}
+
+	root = addSeparatorAtEnd(resolvePath(root))
 
 	return root, nil
 }
 
 func (b *Builder) loadDependencies() ([]*modDependency, error) {
-	output, err := b.Console.RunAndReturnOutput(b.GO, "mod", "download", "-json")
+	args := []interface{}{b.GO, "mod", "download", "-json"}
+
+	var mods []string
+	filtered := false
+
+	if b.cfg.LicenseCheck.DirectDepsOnly {
+		direct, err := b.loadDirectDependencies()
+		if err != nil {
+			return nil, err
+		}
+
+		mods = direct
+		filtered = true
+	}
+
+	if b.cfg.LicenseCheck.LinkedDepsOnly {
+		linked, err := b.loadLinkedDependencies()
+		if err != nil {
+			return nil, err
+		}
+
+		if filtered {
+			var both []string
+			for _, l := range linked {
+				if containsString(mods, l) {
+					both = append(both, l)
+				}
+			}
+			linked = both
+		}
+
+		mods = linked
+		filtered = true
+	}
+
+	if filtered {
+		if len(mods) == 0 {
+			return nil, nil
+		}
+
+		for _, m := range mods {
+			args = append(args, m)
+		}
+	}
+
+	output, err := b.Console.RunAndReturnOutput(args...)
 	if err != nil {
 		return nil, err
 	}
@@ -324,6 +2543,122 @@ func (b *Builder) loadDependencies() ([]*modDependency, error) {
 	return deps, nil
 }
 
+// loadDirectDependencies returns the direct requirements of the module, or the union of the direct requirements of
+// all the modules of the workspace, without the workspace modules themselves
+func (b *Builder) loadDirectDependencies() ([]string, error) {
+	workspace := map[string]bool{}
+	for _, mod := range b.Code.Modules {
+		workspace[mod.Path] = true
+	}
+
+	var result []string
+	for _, mod := range b.Code.Modules {
+		ast, err := parseModFile(mod.Dir)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range ast.Require {
+			if !r.Indirect && !workspace[r.Mod.Path] && !containsString(result, r.Mod.Path) {
+				result = append(result, r.Mod.Path)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// verifyModuleSums checks that the hashes of the downloaded modules are the ones in go.sum, or go.work.sum when using
+// a go.work file
+func (b *Builder) verifyModuleSums(deps []*modDependency) error {
+	files := []string{filepath.Join(b.Code.BaseDir, "go.work.sum")}
+	for _, mod := range b.Code.Modules {
+		files = append(files, filepath.Join(mod.Dir, "go.sum"))
+	}
+
+	sums := map[string]string{}
+	for _, file := range files {
+		data, err := os.ReadFile(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, l := range splitLines(string(data)) {
+			fields := strings.Fields(l)
+			if len(fields) == 3 {
+				sums[fields[0]+" "+fields[1]] = fields[2]
+			}
+		}
+	}
+
+	var mismatches []string
+	for _, dep := range deps {
+		for _, s := range []struct{ version, sum string }{
+			{dep.Version, dep.Sum},
+			{dep.Version + "/go.mod", dep.GoModSum},
+		} {
+			if s.sum == "" {
+				continue
+			}
+
+			expected, ok := sums[dep.Path+" "+s.version]
+			switch {
+			case !ok:
+				fmt.Fprintf(b.Err, "WARNING: %v %v not found in go.sum\n", dep.Path, s.version)
+			case expected != s.sum:
+				mismatches = append(mismatches, fmt.Sprintf("%v %v: downloaded %v, go.sum has %v",
+					dep.Path, s.version, s.sum, expected))
+			}
+		}
+	}
+
+	if len(mismatches) > 0 {
+		return errors.Errorf("module hashes don't match go.sum:\n%v", strings.Join(mismatches, "\n"))
+	}
+
+	return nil
+}
+
+// loadLinkedDependencies returns the modules of the packages linked into the executables, for the host arch.
+func (b *Builder) loadLinkedDependencies() ([]string, error) {
+	args := b.goCommand("list", "-deps", "-f", "{{with .Module}}{{if not .Main}}{{.Path}}{{end}}{{end}}")
+
+	paths := map[string]bool{}
+	for _, e := range b.Executables {
+		if !paths[e.Path] {
+			paths[e.Path] = true
+			args = append(args, e.Path)
+		}
+	}
+
+	if len(paths) == 0 {
+		return nil, nil
+	}
+
+	args = append([]interface{}{"cd " + b.Code.BaseDir}, args...)
+
+	output, err := b.Console.RunAndReturnOutput(args...)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := map[string]bool{}
+	var result []string
+	for _, l := range splitLines(output) {
+		if l != "" && !seen[l] {
+			seen[l] = true
+			result = append(result, l)
+		}
+	}
+
+	sort.Strings(result)
+
+	return result, nil
+}
+
 func (b *Builder) fillLicenseInfo(dep *modDependency, modCacheRoot string) error {
 	licenseFileNames, err := b.findLicenseFilesSearchingParents(dep, modCacheRoot)
 	if err != nil {
@@ -336,24 +2671,64 @@ func (b *Builder) fillLicenseInfo(dep *modDependency, modCacheRoot string) error
 			return err
 		}
 
-		license := licenseInfo{
+		license := LicenseInfo{
+			Name:     b.classifyLicense(dep.Path, data),
 			Contents: string(data),
 		}
 
-		cov := licensecheck.Scan(data)
-		if cov.Percent >= 75 { // Same as pkg.go.dev
-			license.Name = cov.Match[0].ID
+		dep.Licenses = append(dep.Licenses, license)
+	}
+
+	if name, ok := b.cfg.LicenseOverrides[dep.Path]; ok {
+		if len(dep.Licenses) == 0 {
+			dep.Licenses = append(dep.Licenses, LicenseInfo{})
+		}
+
+		// The files are kept, but all are assumed to be the overridden license
+		for i := range dep.Licenses {
+			dep.Licenses[i].Name = name
 		}
+	}
 
-		dep.Licenses = append(dep.Licenses, license)
+	// NOTICE files are expected to live next to the license
+	noticeDir := dep.Dir
+	if len(licenseFileNames) > 0 {
+		noticeDir = filepath.Dir(licenseFileNames[0])
+	}
+	if noticeDir == "" {
+		return nil
+	}
+
+	noticeFileNames, err := b.findNoticeFiles(noticeDir)
+	if err != nil {
+		return err
+	}
+
+	for _, noticeFileName := range noticeFileNames {
+		data, err := os.ReadFile(noticeFileName)
+		if err != nil {
+			return err
+		}
+
+		dep.Notices = append(dep.Notices, string(data))
 	}
 
 	return nil
 }
 
 func (b *Builder) findLicenseFilesSearchingParents(dep *modDependency, modCacheRoot string) ([]string, error) {
-	path := dep.Dir
-	for len(path) > len(modCacheRoot) {
+	if dep.Dir == "" {
+		return nil, nil
+	}
+
+	path := addSeparatorAtEnd(resolvePath(dep.Dir))
+
+	// Replaced or vendored modules are outside the module cache, so there is no safe boundary to walk up to
+	if !strings.HasPrefix(path, modCacheRoot) {
+		return b.findLicenseFiles(path)
+	}
+
+	for len(path) > len(modCacheRoot) && strings.HasPrefix(path, modCacheRoot) {
 		fileNames, err := b.findLicenseFiles(path)
 		if err != nil {
 			return nil, err
@@ -363,8 +2738,13 @@ func (b *Builder) findLicenseFilesSearchingParents(dep *modDependency, modCacheR
 			return fileNames, nil
 		}
 
-		// Try parent folder
-		path = addSeparatorAtEnd(filepath.Dir(path))
+		// The go.mod is in the module root, so the parents belong to other modules and their licenses are not ours
+		if _, err := os.Stat(filepath.Join(path, "go.mod")); err == nil {
+			break
+		}
+
+		// Try parent folder. Dir needs the path without the separator at the end, or it returns the same folder.
+		path = addSeparatorAtEnd(filepath.Dir(filepath.Clean(path)))
 	}
 
 	return nil, nil
@@ -432,14 +2812,41 @@ func (b *Builder) findLicenseFiles(path string) ([]string, error) {
 	return result, nil
 }
 
+func (b *Builder) findNoticeFiles(path string) ([]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var result []string
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		name := strings.ToLower(entry.Name())
+		if name != "notice" && name != "notice.txt" && name != "notice.md" {
+			continue
+		}
+
+		result = append(result, filepath.Join(path, entry.Name()))
+	}
+
+	return result, nil
+}
+
 type modDependency struct {
 	Path     string
 	Version  string
 	Dir      string
-	Licenses []licenseInfo
+	Sum      string
+	GoModSum string
+	Licenses []LicenseInfo
+	Notices  []string
 }
 
-type licenseInfo struct {
+type LicenseInfo struct {
 	Name     string
 	Contents string
 }
@@ -0,0 +1,913 @@
+package build
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+func TestRunZipWithCompressionStoreIsUncompressed(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.Archs = []string{"host"}
+	cfg.CompressionLevel = CompressionStore
+
+	b := newTestBuilder(t, testMainFiles, cfg)
+
+	exec := b.Executables[0]
+	arch := exec.Archs[0]
+
+	output, err := b.GetOutputExecutableName(exec, arch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(output), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.WriteFile(output, bytes.Repeat([]byte("compressible "), 1000), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.RunZip(exec, arch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputZip, err := b.GetOutputZipName(exec, arch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.OpenReader(outputZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if len(r.File) == 0 {
+		t.Fatal("empty zip")
+	}
+
+	for _, f := range r.File {
+		if f.Method != zip.Store {
+			t.Errorf("%v: expected method store, got %v", f.Name, f.Method)
+		}
+		if f.CompressedSize64 != f.UncompressedSize64 {
+			t.Errorf("%v: compressed size %v != uncompressed size %v", f.Name, f.CompressedSize64,
+				f.UncompressedSize64)
+		}
+	}
+}
+
+func TestRunZipWritesTarZst(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.Archs = []string{"host"}
+	cfg.ArchiveFormat = "tar.zst"
+	cfg.ZstdLevel = 19
+
+	b := newTestBuilder(t, testMainFiles, cfg)
+
+	exec := b.Executables[0]
+	arch := exec.Archs[0]
+
+	output, err := b.GetOutputExecutableName(exec, arch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(filepath.Dir(output), 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := bytes.Repeat([]byte("compressible "), 1000)
+
+	err = os.WriteFile(output, data, 0o755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = b.RunZip(exec, arch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputZip, err := b.GetOutputZipName(exec, arch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(outputZip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	zr, err := zstd.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer zr.Close()
+
+	tr := tar.NewReader(zr)
+
+	header, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Name != filepath.Base(output) {
+		t.Errorf("unexpected file in tar: %v", header.Name)
+	}
+
+	contents, err := io.ReadAll(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(contents, data) {
+		t.Error("executable changed in tar")
+	}
+}
+
+func TestRunZipConcurrently(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.Archs = []string{"linux/amd64", "linux/arm64", "windows/amd64", "darwin/amd64"}
+
+	b := newTestBuilder(t, testMainFiles, cfg)
+
+	exec := b.Executables[0]
+
+	for _, arch := range exec.Archs {
+		output, err := b.GetOutputExecutableName(exec, arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.MkdirAll(filepath.Dir(output), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = os.WriteFile(output, []byte(arch), 0o755)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each arch is zipped twice at the same time, to also race on the same zip
+	errs := make(chan error, 2*len(exec.Archs))
+	for i := 0; i < 2; i++ {
+		for _, arch := range exec.Archs {
+			go func(arch string) {
+				errs <- b.RunZip(exec, arch)
+			}(arch)
+		}
+	}
+
+	for i := 0; i < cap(errs); i++ {
+		err := <-errs
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	zips := 0
+	for _, a := range b.Artifacts() {
+		if a.Kind == "zip" {
+			zips++
+		}
+	}
+	if zips != len(exec.Archs) {
+		t.Errorf("expected %v zip artifacts, got %v", len(exec.Archs), zips)
+	}
+
+	for _, arch := range exec.Archs {
+		outputZip, err := b.GetOutputZipName(exec, arch)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		r, err := zip.OpenReader(outputZip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = r.Close()
+	}
+}
+
+func TestRunZipKeepsHashInCacheFolder(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.Archs = []string{"linux/amd64"}
+
+	b := newTestBuilder(t, testMainFiles, cfg)
+
+	exec := b.Executables[0]
+	arch := exec.Archs[0]
+
+	output, err := b.GetOutputExecutableName(exec, arch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFiles(t, filepath.Dir(output), map[string]string{filepath.Base(output): "executable"})
+
+	err = b.RunZip(exec, arch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	outputZip, err := b.GetOutputZipName(exec, arch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hashFile := filepath.Join(filepath.Dir(outputZip), ".cache", filepath.Base(outputZip)+zipHashSuffix)
+
+	_, err = os.Stat(hashFile)
+	if err != nil {
+		t.Errorf("hash file not in the cache folder: %v", err)
+	}
+
+	_, err = os.Stat(outputZip + zipHashSuffix)
+	if !os.IsNotExist(err) {
+		t.Errorf("hash file next to the zip: %v", err)
+	}
+
+	err = b.RunCleanZip()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file := range []string{outputZip, hashFile} {
+		_, err = os.Stat(file)
+		if !os.IsNotExist(err) {
+			t.Errorf("%v was not cleaned: %v", file, err)
+		}
+	}
+}
+
+func TestGetOutputTestBinaryNameUsesPathInsideModule(t *testing.T) {
+	b := newTestBuilder(t, testMainFiles, nil)
+
+	for pkg, expected := range map[string]string{
+		".":                          "example.test",
+		"./a/util":                   "a-util.test",
+		"b/util":                     "b-util.test",
+		"example.com/example":        "example.test",
+		"example.com/example/a/util": "a-util.test",
+	} {
+		output, err := b.GetOutputTestBinaryName(pkg, "linux/amd64")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if filepath.Base(output) != expected {
+			t.Errorf("%v: expected %v, got %v", pkg, expected, filepath.Base(output))
+		}
+	}
+}
+
+func TestGetOutputTestBinaryNameUsesArchDirFormat(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.ArchDirFormat = "{{.OS}}_{{.Arch}}"
+
+	b := newTestBuilder(t, testMainFiles, cfg)
+
+	exec, err := b.GetOutputExecutableName(b.Executables[0], "linux/amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	test, err := b.GetOutputTestBinaryName("example.com/example", "linux/amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := filepath.Join(b.Code.BaseDir, "build", "linux_amd64")
+	if filepath.Dir(exec) != expected || filepath.Dir(test) != expected {
+		t.Errorf("expected both in %v, got %v and %v", expected, exec, test)
+	}
+}
+
+func TestGetOutputExecutableNameUsesOSSeparators(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.Archs = []string{"linux/amd64", "windows/amd64"}
+
+	b := newTestBuilder(t, testMainFiles, cfg)
+
+	output, err := b.GetOutputExecutableName(b.Executables[0], "windows/amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := filepath.Join(b.Code.BaseDir, "build", "windows", "amd64", "example.exe")
+	if output != expected {
+		t.Errorf("expected %v, got %v", expected, output)
+	}
+}
+
+func TestZipOfHostArchRunsAfterSmokeTest(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.Archs = []string{"host"}
+	cfg.CleanBinariesAfterZip = true
+	cfg.SmokeTests = map[string][]string{"example": {"--version"}}
+
+	b := newTestBuilder(t, testMainFiles, cfg)
+
+	exec := b.Executables[0]
+
+	order, err := b.Targets.ComputeTargetRunOrder("zip:" + exec.TargetName() + ":" + exec.Archs[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	smoke := -1
+	for i, target := range order {
+		if target == "smoke:"+exec.TargetName() {
+			smoke = i
+		}
+	}
+
+	if smoke < 0 || smoke >= len(order)-1 {
+		t.Errorf("smoke test does not run before the zip: %v", order)
+	}
+}
+
+func TestCleanBinariesAfterZipKeepsExecutablesUntilTheEndOfTheRun(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.Archs = []string{"linux/amd64"}
+	cfg.CleanBinariesAfterZip = true
+
+	b := newTestBuilder(t, testMainFiles, cfg)
+
+	exec := b.Executables[0]
+	arch := exec.Archs[0]
+
+	output, err := b.GetOutputExecutableName(exec, arch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFiles(t, filepath.Dir(output), map[string]string{filepath.Base(output): "executable"})
+
+	existedAfterZip := false
+	b.Targets.Add("test-zip", nil, func() error {
+		return b.RunZip(exec, arch)
+	})
+	b.Targets.Add("test-use", []string{"test-zip"}, func() error {
+		_, err := os.Stat(output)
+		existedAfterZip = err == nil
+		return nil
+	})
+
+	err = b.RunTarget("test-use")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !existedAfterZip {
+		t.Error("the executable was removed before the targets after the zip ran")
+	}
+
+	_, err = os.Stat(output)
+	if !os.IsNotExist(err) {
+		t.Errorf("the executable was not removed at the end of the run: %v", err)
+	}
+}
+
+func TestFillLicenseInfoWithoutDir(t *testing.T) {
+	b := newTestBuilder(t, testMainFiles, nil)
+
+	dep := &modDependency{Path: "example.com/dep", Version: "v1.0.0"}
+
+	err := b.fillLicenseInfo(dep, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(dep.Licenses) != 0 || len(dep.Notices) != 0 {
+		t.Errorf("unexpected licenses or notices: %v", dep)
+	}
+}
+
+func TestLoadDirectDependenciesOfWorkspace(t *testing.T) {
+	b := newTestBuilder(t, map[string]string{
+		"go.work": "go 1.17\n\nuse (\n\t./a\n\t./b\n)\n",
+		"a/go.mod": "module example.com/a\n\ngo 1.17\n\nrequire (\n\texample.com/b v0.0.0\n" +
+			"\texample.com/x v1.0.0\n\texample.com/i v1.0.0 // indirect\n)\n",
+		"a/main.go": "package main\n\nfunc main() {}\n",
+		"b/go.mod":  "module example.com/b\n\ngo 1.17\n\nrequire (\n\texample.com/x v1.0.0\n\texample.com/y v1.0.0\n)\n",
+	}, nil)
+
+	direct, err := b.loadDirectDependencies()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(direct, ",") != "example.com/x,example.com/y" {
+		t.Errorf("unexpected direct dependencies: %v", direct)
+	}
+}
+
+func TestWriteThirdPartyNotices(t *testing.T) {
+	b := newTestBuilder(t, testMainFiles, nil)
+
+	err := b.writeThirdPartyNotices([]*modDependency{
+		{Path: "example.com/a", Version: "v1.0.0", Notices: []string{"Copyright A\n"}},
+		{Path: "example.com/b", Version: "v2.0.0"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output, err := b.GetOutputNoticesName()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "example.com/a v1.0.0\n\nCopyright A\n\n"
+	if string(data) != expected {
+		t.Errorf("expected %q, got %q", expected, string(data))
+	}
+}
+
+func TestCreateTinyGoBuildCommandSkipsGoOnlyArgs(t *testing.T) {
+	b := newTestBuilder(t, testMainFiles, nil)
+	b.TINYGO = "tinygo"
+
+	exec := b.Executables[0]
+	exec.BuildArgs = []string{"-trimpath", "-buildvcs=false", "-mod", "vendor", "-tags=x"}
+
+	cmd, err := b.createTinyGoBuildCommand(exec, "linux/amd64", "out", io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := map[string]bool{}
+	for _, a := range cmd {
+		args[fmt.Sprint(a)] = true
+	}
+
+	for _, a := range []string{"-trimpath", "-buildvcs=false", "-mod", "vendor"} {
+		if args[a] {
+			t.Errorf("unexpected %v in %v", a, cmd)
+		}
+	}
+	for _, a := range []string{"-tags=x", "CGO_ENABLED=0"} {
+		if !args[a] {
+			t.Errorf("expected %v in %v", a, cmd)
+		}
+	}
+}
+
+func TestPGOProfilesOverrideDefaultPGO(t *testing.T) {
+	files := map[string]string{
+		"go.mod":      "module example.com/example\n\ngo 1.17\n",
+		"main.go":     "package main\n\nfunc main() {}\n",
+		"default.pgo": "",
+		"release.pgo": "",
+	}
+
+	cfg := NewBuilderConfig()
+	cfg.PGOProfiles = map[string]string{"example": "release.pgo"}
+
+	b := newTestBuilder(t, files, cfg)
+
+	exec := b.Executables[0]
+
+	expected := filepath.Join(b.Code.BaseDir, "release.pgo")
+	if exec.PGOProfile != expected {
+		t.Fatalf("expected %v, got %v", expected, exec.PGOProfile)
+	}
+
+	cmd, err := b.createGoBuildCommand(exec, "linux/amd64", "out", io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	found := false
+	for _, a := range cmd {
+		if fmt.Sprint(a) == "-pgo="+expected {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected -pgo=%v in %v", expected, cmd)
+	}
+}
+
+func TestDetectedDefaultPGOIsIgnoredWithoutWarningByTinyGo(t *testing.T) {
+	files := map[string]string{
+		"go.mod":      "module example.com/example\n\ngo 1.17\n",
+		"main.go":     "package main\n\nfunc main() {}\n",
+		"default.pgo": "",
+	}
+
+	b := newTestBuilder(t, files, nil)
+	b.TINYGO = "tinygo"
+
+	exec := b.Executables[0]
+	if exec.PGOProfile == "" {
+		t.Fatal("default.pgo not detected")
+	}
+
+	var warnings bytes.Buffer
+
+	_, err := b.createTinyGoBuildCommand(exec, "linux/amd64", "out", &warnings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if warnings.Len() > 0 {
+		t.Errorf("unexpected warnings: %v", warnings.String())
+	}
+
+	exec.PGOProfile = filepath.Join(b.Code.BaseDir, "default.pgo")
+	exec.pgoDetected = false
+
+	_, err = b.createTinyGoBuildCommand(exec, "linux/amd64", "out", &warnings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if warnings.Len() == 0 {
+		t.Error("expected a warning for an explicit profile")
+	}
+}
+
+func TestExplainDescribesAllDefaultTargets(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.Archs = []string{"linux/amd64", "windows/amd64", "darwin/amd64"}
+	cfg.GenerateBuildInfo = true
+	cfg.WindowsSign.CertFile = "cert.p12"
+	cfg.MacSign.Identity = "me"
+	cfg.SmokeTests = map[string][]string{"example": {"--version"}}
+	cfg.TestBinaries.Packages = []string{"."}
+	cfg.Images = []Image{{Executable: "example", Repository: "example.com/example"}}
+
+	b := newTestBuilder(t, testMainFiles, cfg)
+
+	for _, name := range b.Targets.Names() {
+		plan, err := b.Explain(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Contains(plan, "custom func") {
+			t.Errorf("target without description in %v:\n%v", name, plan)
+		}
+	}
+}
+
+func TestFindLicenseFilesSearchingParentsInNestedModuleLayout(t *testing.T) {
+	b := newTestBuilder(t, testMainFiles, nil)
+
+	cache := t.TempDir()
+	writeTestFiles(t, cache, map[string]string{
+		"LICENSE":                               "outside of any module",
+		"example.com/mod@v1.0.0/LICENSE":        "MIT",
+		"example.com/mod@v1.0.0/sub/pkg/doc.go": "package pkg\n",
+		"example.com/nolicense@v1.0.0/go.mod":   "module example.com/nolicense\n",
+		"example.com/nolicense@v1.0.0/pkg/a.go": "package pkg\n",
+		"replaced/go.mod":                       "module example.com/replaced\n",
+	})
+
+	root := addSeparatorAtEnd(resolvePath(cache))
+
+	files, err := b.findLicenseFilesSearchingParents(&modDependency{
+		Dir: filepath.Join(cache, "example.com", "mod@v1.0.0", "sub", "pkg"),
+	}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || filepath.Base(filepath.Dir(files[0])) != "mod@v1.0.0" {
+		t.Errorf("expected the module license, got %v", files)
+	}
+
+	// The walk must stop before the module cache root
+	files, err = b.findLicenseFilesSearchingParents(&modDependency{
+		Dir: filepath.Join(cache, "example.com", "nolicense@v1.0.0", "pkg"),
+	}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected no license, got %v", files)
+	}
+
+	// Dirs outside the module cache are not walked up
+	files, err = b.findLicenseFilesSearchingParents(&modDependency{
+		Dir: filepath.Join(cache, "replaced"),
+	}, addSeparatorAtEnd(resolvePath(filepath.Join(cache, "example.com"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 0 {
+		t.Errorf("expected no license, got %v", files)
+	}
+}
+
+func TestFindLicenseFilesSearchingParentsStopsAtModuleRoot(t *testing.T) {
+	b := newTestBuilder(t, testMainFiles, nil)
+
+	cache := t.TempDir()
+	writeTestFiles(t, cache, map[string]string{
+		"example.com/outer@v1.0.0/LICENSE":            "MIT",
+		"example.com/outer@v1.0.0/go.mod":             "module example.com/outer\n",
+		"example.com/outer@v1.0.0/pkg/a.go":           "package pkg\n",
+		"example.com/outer@v1.0.0/inner/go.mod":       "module example.com/outer/inner\n",
+		"example.com/outer@v1.0.0/inner/pkg/inner.go": "package pkg\n",
+	})
+
+	root := addSeparatorAtEnd(resolvePath(cache))
+
+	// Packages of the outer module use its license
+	files, err := b.findLicenseFilesSearchingParents(&modDependency{
+		Dir: filepath.Join(cache, "example.com", "outer@v1.0.0", "pkg"),
+	}, root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Errorf("expected the outer license, got %v", files)
+	}
+
+	// The inner module has no license, and must not get the outer one
+	for _, dir := range []string{"inner", filepath.Join("inner", "pkg")} {
+		files, err = b.findLicenseFilesSearchingParents(&modDependency{
+			Dir: filepath.Join(cache, "example.com", "outer@v1.0.0", dir),
+		}, root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(files) != 0 {
+			t.Errorf("%v: expected no license, got %v", dir, files)
+		}
+	}
+}
+
+func TestRunTargetForgetsFailedBuildsOfPreviousRuns(t *testing.T) {
+	b := newTestBuilder(t, testMainFiles, nil)
+
+	b.setBuildFailed("build:example:linux/amd64")
+
+	err := b.RunTarget("version")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b.buildFailed("build:example:linux/amd64") {
+		t.Error("failed build of previous run still recorded")
+	}
+}
+
+func TestValidateExecutableReportsGoError(t *testing.T) {
+	b := newTestBuilder(t, map[string]string{
+		"go.mod":     "module example.com/example\n\ngo 1.17\n",
+		"main.go":    "package main\n\nfunc main() {}\n",
+		"empty/a.md": "not go\n",
+	}, nil)
+
+	exec := b.Executables[0]
+	exec.Path = filepath.Join(b.Code.BaseDir, "empty")
+
+	err := b.validateExecutable(exec, "linux/amd64")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	if !strings.Contains(err.Error(), "no Go files") {
+		t.Errorf("expected the go list error, got %v", err)
+	}
+}
+
+func TestValidateExecutableUsesTheArchEnvironment(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.Archs = []string{"windows/amd64"}
+
+	b := newTestBuilder(t, map[string]string{
+		"go.mod":  "module example.com/example\n\ngo 1.17\n",
+		"main.go": "//go:build windows\n\npackage main\n\nfunc main() {}\n",
+	}, cfg)
+
+	if len(b.Executables) != 1 {
+		t.Fatalf("expected 1 executable, got %v", len(b.Executables))
+	}
+
+	exec := b.Executables[0]
+
+	err := b.validateExecutable(exec, "windows/amd64")
+	if err != nil {
+		t.Errorf("unexpected error for windows: %v", err)
+	}
+
+	err = b.validateExecutable(exec, "linux/amd64")
+	if err == nil {
+		t.Error("expected an error for linux")
+	}
+}
+
+func TestResetRunStateForgetsExecutableValidations(t *testing.T) {
+	b := newTestBuilder(t, testMainFiles, nil)
+
+	exec := b.Executables[0]
+	exec.Path = filepath.Join(b.Code.BaseDir, "later")
+
+	err := b.validateExecutable(exec, "linux/amd64")
+	if err == nil {
+		t.Fatal("expected error")
+	}
+
+	writeTestFiles(t, b.Code.BaseDir, map[string]string{
+		"later/main.go": "package main\n\nfunc main() {}\n",
+	})
+
+	b.resetRunState()
+
+	err = b.validateExecutable(exec, "linux/amd64")
+	if err != nil {
+		t.Errorf("validation error was cached: %v", err)
+	}
+}
+
+func TestRunZipArchivesDebugInfoSeparately(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.Archs = []string{"linux/amd64"}
+
+	b := newTestBuilder(t, testMainFiles, cfg)
+
+	exec := b.Executables[0]
+	exec.SplitDebug = true
+
+	output, err := b.GetOutputExecutableName(exec, "linux/amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeTestFiles(t, filepath.Dir(output), map[string]string{
+		filepath.Base(output):            "executable",
+		filepath.Base(output) + ".debug": "debug info",
+	})
+
+	err = b.RunZip(exec, "linux/amd64")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"zip", "debug-zip"} {
+		var archive string
+		for _, a := range b.Artifacts() {
+			if a.Kind == name {
+				archive = a.Path
+			}
+		}
+
+		r, err := zip.OpenReader(archive)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var files []string
+		for _, f := range r.File {
+			files = append(files, f.Name)
+		}
+		r.Close()
+
+		expected := "example"
+		if name == "debug-zip" {
+			expected = "example.debug"
+		}
+		if len(files) != 1 || files[0] != expected {
+			t.Errorf("%v: expected only %v, got %v", name, expected, files)
+		}
+	}
+}
+
+func TestWarnCgoCrossCompile(t *testing.T) {
+	cfg := NewBuilderConfig()
+	cfg.EnvFile = ".env"
+
+	b := newTestBuilder(t, testMainFiles, cfg)
+
+	var stderr bytes.Buffer
+	b.SetOutput(io.Discard, &stderr)
+
+	arch := "linux/riscv64"
+	if b.GO_GOOS == "linux" && b.GO_GOARCH == "riscv64" {
+		arch = "linux/amd64"
+	}
+
+	b.warnCgoCrossCompile(arch, true)
+	b.warnCgoCrossCompile(arch, true)
+
+	if os.Getenv("CC") == "" && strings.Count(stderr.String(), "WARNING") != 1 {
+		t.Errorf("expected one warning, got %q", stderr.String())
+	}
+
+	b = newTestBuilder(t, map[string]string{
+		"go.mod":  testMainFiles["go.mod"],
+		"main.go": testMainFiles["main.go"],
+		".env":    "CC=riscv64-linux-gnu-gcc\n",
+	}, cfg)
+
+	if b.missingCrossCompiler(arch) {
+		t.Error("CC from the env file was ignored")
+	}
+}
+
+func TestRunBuildAllWithKeepGoingReturnsAllErrors(t *testing.T) {
+	files := map[string]string{
+		"go.mod":        "module example.com/example\n\ngo 1.17\n",
+		"cmd/a/main.go": "package main\n\nfunc main() { undefinedA() }\n",
+		"cmd/b/main.go": "package main\n\nfunc main() { undefinedB() }\n",
+	}
+
+	for _, keepGoing := range []bool{false, true} {
+		cfg := NewBuilderConfig()
+		cfg.Archs = []string{"host"}
+		cfg.KeepGoing = keepGoing
+
+		b := newTestBuilder(t, files, cfg)
+
+		err := b.RunBuildAll()
+		if err == nil {
+			t.Fatal("expected an error")
+		}
+
+		var all *BuildAllError
+		if errors.As(err, &all) != keepGoing {
+			t.Errorf("KeepGoing %v: unexpected error type: %v", keepGoing, err)
+		}
+		if keepGoing && len(all.Errors) != 2 {
+			t.Errorf("expected 2 errors, got %v", all.Errors)
+		}
+	}
+}
+
+func TestTargetsInTheSameSerializationGroupDoNotOverlap(t *testing.T) {
+	b := newTestBuilder(t, testMainFiles, nil)
+
+	var mutex sync.Mutex
+	running := 0
+	maxRunning := 0
+
+	run := func() error {
+		mutex.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mutex.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mutex.Lock()
+		running--
+		mutex.Unlock()
+
+		return nil
+	}
+
+	names := []string{"g1", "g2", "g3", "g4"}
+	for _, name := range names {
+		b.Targets.Add(name, nil, run).InGroup("group")
+	}
+
+	var wg sync.WaitGroup
+	for _, name := range names {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+
+			err := b.RunTarget(name)
+			if err != nil {
+				t.Error(err)
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	if maxRunning != 1 {
+		t.Errorf("expected 1 target running at a time, got %v", maxRunning)
+	}
+}
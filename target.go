@@ -1,6 +1,15 @@
 package build
 
-import "github.com/pkg/errors"
+import (
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
 
 type Targets struct {
 	items map[string]*Target
@@ -32,14 +41,68 @@ func (l *Targets) Add(name string, dependencies []string, code TargetRunFunc) *T
 	return t
 }
 
+// Names returns the names of all targets, sorted.
+func (l *Targets) Names() []string {
+	result := make([]string, 0, len(l.items))
+	for name := range l.items {
+		result = append(result, name)
+	}
+
+	sort.Strings(result)
+
+	return result
+}
+
+// Match returns the names of the targets matching a glob pattern, sorted. In the pattern, * matches any sequence of
+// characters (including / and :) and ? matches one character.
+func (l *Targets) Match(pattern string) []string {
+	var re strings.Builder
+	re.WriteString("^")
+	for _, c := range pattern {
+		switch c {
+		case '*':
+			re.WriteString(".*")
+		case '?':
+			re.WriteString(".")
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	re.WriteString("$")
+
+	matcher := regexp.MustCompile(re.String())
+
+	var result []string
+	for _, name := range l.Names() {
+		if matcher.MatchString(name) {
+			result = append(result, name)
+		}
+	}
+
+	return result
+}
+
 func (l *Targets) ComputeTargetRunOrder(name string) ([]string, error) {
+	return l.ComputeTargetsRunOrder(name)
+}
+
+// ComputeTargetsRunOrder returns the combined run order of all the targets, running each only once.
+func (l *Targets) ComputeTargetsRunOrder(names ...string) ([]string, error) {
+	var err error
 	var result []string
 	visited := map[string]int{}
 
-	return l.dfs(result, visited, name)
+	for _, name := range names {
+		result, err = l.dfs(result, visited, nil, name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
 }
 
-func (l *Targets) dfs(result []string, visited map[string]int, name string) ([]string, error) {
+func (l *Targets) dfs(result []string, visited map[string]int, stack []string, name string) ([]string, error) {
 	var err error
 
 	v, ok := visited[name]
@@ -49,20 +112,27 @@ func (l *Targets) dfs(result []string, visited map[string]int, name string) ([]s
 
 	switch v {
 	case 1:
-		return nil, errors.Errorf("cycle identified in targets graph")
+		cycle := []string{name}
+		for i := len(stack) - 1; i >= 0 && stack[i] != name; i-- {
+			cycle = append([]string{stack[i]}, cycle...)
+		}
+		cycle = append([]string{name}, cycle...)
+
+		return nil, errors.WithStack(&TargetCycleError{Path: cycle})
 	case 2:
 		return result, nil
 	}
 
 	t := l.Get(name)
 	if t == nil {
-		return nil, errors.Errorf("unknown target: %v", name)
+		return nil, errors.WithStack(&UnknownTargetError{Name: name})
 	}
 
 	visited[name] = 1
+	stack = append(stack, name)
 
 	for _, dep := range t.Dependencies {
-		result, err = l.dfs(result, visited, dep)
+		result, err = l.dfs(result, visited, stack, dep)
 		if err != nil {
 			return nil, err
 		}
@@ -77,14 +147,103 @@ func (l *Targets) dfs(result []string, visited map[string]int, name string) ([]s
 	return result, nil
 }
 
+// WriteGraph writes the targets and their dependencies as a graph, in graphviz dot or mermaid format. Targets that
+// only group others are drawn with a dashed border.
+func (l *Targets) WriteGraph(w io.Writer, format string) error {
+	names := l.Names()
+
+	ids := map[string]string{}
+	for i, name := range names {
+		ids[name] = fmt.Sprintf("t%v", i)
+	}
+
+	switch format {
+	case "dot":
+		fmt.Fprintln(w, "digraph targets {")
+		fmt.Fprintln(w, "  rankdir=LR;")
+		fmt.Fprintln(w, "  node [shape=box];")
+		for _, name := range names {
+			style := ""
+			if l.items[name].run == nil {
+				style = ", style=dashed"
+			}
+			fmt.Fprintf(w, "  %v [label=%v%v];\n", ids[name], strconv.Quote(name), style)
+		}
+		for _, name := range names {
+			for _, dep := range l.items[name].Dependencies {
+				fmt.Fprintf(w, "  %v -> %v;\n", ids[name], graphID(ids, dep))
+			}
+		}
+		fmt.Fprintln(w, "}")
+
+	case "mermaid":
+		fmt.Fprintln(w, "graph LR")
+		for _, name := range names {
+			fmt.Fprintf(w, "  %v[\"%v\"]\n", ids[name], strings.ReplaceAll(name, `"`, "#quot;"))
+			if l.items[name].run == nil {
+				fmt.Fprintf(w, "  style %v stroke-dasharray: 5 5\n", ids[name])
+			}
+		}
+		for _, name := range names {
+			for _, dep := range l.items[name].Dependencies {
+				fmt.Fprintf(w, "  %v --> %v\n", ids[name], graphID(ids, dep))
+			}
+		}
+
+	default:
+		return errors.Errorf("unknown graph format: %v", format)
+	}
+
+	return nil
+}
+
+// graphID returns the id of a target in the graph, using its quoted name for unknown dependencies
+func graphID(ids map[string]string, name string) string {
+	id, ok := ids[name]
+	if !ok {
+		return strconv.Quote(name)
+	}
+
+	return id
+}
+
+// UnknownTargetError is returned when a target, or a target dependency, does not exist.
+type UnknownTargetError struct {
+	Name string
+}
+
+func (e *UnknownTargetError) Error() string {
+	return "unknown target: " + e.Name
+}
+
+// TargetCycleError is returned when the target dependencies have a cycle. Path starts and ends with the same target.
+type TargetCycleError struct {
+	Path []string
+}
+
+func (e *TargetCycleError) Error() string {
+	return "cycle identified in targets graph: " + strings.Join(e.Path, " -> ")
+}
+
 type Target struct {
 	Name         string
 	Dependencies []string
-	run          TargetRunFunc
+	// Targets in the same serialization group never run at the same time, even when run from different goroutines.
+	// Empty means no group.
+	SerializationGroup string
+	run                TargetRunFunc
+	// Optional description of what run does, used by Builder.Explain
+	describe func() (string, error)
 }
 
 func (t *Target) AddDependency(dep *Target) {
 	t.Dependencies = append(t.Dependencies, dep.Name)
 }
 
+// InGroup sets the serialization group of the target and returns it, to be chained with Targets.Add.
+func (t *Target) InGroup(group string) *Target {
+	t.SerializationGroup = group
+	return t
+}
+
 type TargetRunFunc func() error
@@ -0,0 +1,33 @@
+package build
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestComputeTargetRunOrderErrors(t *testing.T) {
+	targets := Targets{items: map[string]*Target{}}
+	run := func() error { return nil }
+
+	targets.Add("a", []string{"b"}, run)
+	targets.Add("b", []string{"a"}, run)
+	targets.Add("c", []string{"missing"}, run)
+
+	_, err := targets.ComputeTargetRunOrder("a")
+
+	var cycle *TargetCycleError
+	if !errors.As(err, &cycle) {
+		t.Fatalf("expected cycle error, got %v", err)
+	}
+	if len(cycle.Path) != 3 || cycle.Path[0] != "a" || cycle.Path[2] != "a" {
+		t.Errorf("unexpected cycle path: %v", cycle.Path)
+	}
+
+	_, err = targets.ComputeTargetRunOrder("c")
+
+	var unknown *UnknownTargetError
+	if !errors.As(err, &unknown) || unknown.Name != "missing" {
+		t.Errorf("expected unknown target error, got %v", err)
+	}
+}
@@ -1,6 +1,13 @@
 package build
 
-import "strings"
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
 
 var invalidFilenameChars = []string{
 	"<",
@@ -21,3 +28,164 @@ func fixFilename(name string) string {
 
 	return name
 }
+
+func containsString(list []string, s string) bool {
+	for _, i := range list {
+		if i == s {
+			return true
+		}
+	}
+
+	return false
+}
+
+func writeJSONFile(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0o755)
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(path, data)
+}
+
+// writeFileAtomic writes the file as createFileAtomic
+func writeFileAtomic(path string, data []byte) error {
+	return createFileAtomic(path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// createFileAtomic writes to a temp file in the same folder and renames it to path when write succeeds, so path is
+// never left half written if the build is interrupted
+func createFileAtomic(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+	defer os.Remove(tmp)
+
+	err = write(f)
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(tmp, 0o644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// splitLines returns the non empty lines of the text, handling \r\n too
+func splitLines(text string) []string {
+	var result []string
+	for _, l := range strings.Split(text, "\n") {
+		l = strings.TrimRight(l, "\r")
+		if l != "" {
+			result = append(result, l)
+		}
+	}
+
+	return result
+}
+
+func firstNonEmpty(s ...string) string {
+	for _, i := range s {
+		if i != "" {
+			return i
+		}
+	}
+
+	return ""
+}
+
+func formatSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+
+	if unit == 0 {
+		return fmt.Sprintf("%v %v", size, units[unit])
+	}
+
+	return fmt.Sprintf("%.1f %v", value, units[unit])
+}
+
+// splitArch splits an arch in the go tool dist list format. These always use / as separator, independent of the OS,
+// so they must not be handled with filepath.
+func splitArch(arch string) (string, string) {
+	parts := strings.SplitN(arch, "/", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+func splitEnv(env string) (string, string) {
+	parts := strings.SplitN(env, "=", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+
+	return parts[0], parts[1]
+}
+
+// resolvePath returns the absolute path with symlinks resolved, or the cleaned path if that fails
+func resolvePath(path string) string {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return filepath.Clean(path)
+	}
+
+	resolved, err := filepath.EvalSymlinks(abs)
+	if err != nil {
+		return abs
+	}
+
+	return resolved
+}
+
+// TempDir returns the folder used for temporary files: BuilderConfig.TempDir, relative to BaseDir, or the system
+// temp folder.
+func (b *Builder) TempDir() string {
+	if b.cfg.TempDir != "" && !filepath.IsAbs(b.cfg.TempDir) {
+		return filepath.Join(b.Code.BaseDir, b.cfg.TempDir)
+	}
+
+	if b.cfg.TempDir != "" {
+		return b.cfg.TempDir
+	}
+
+	return os.TempDir()
+}
+
+// createTempDir creates a new folder inside TempDir. The caller must remove it.
+func (b *Builder) createTempDir(pattern string) (string, error) {
+	err := os.MkdirAll(b.TempDir(), 0o755)
+	if err != nil {
+		return "", err
+	}
+
+	return os.MkdirTemp(b.TempDir(), pattern)
+}
@@ -0,0 +1,19 @@
+package build
+
+import (
+	"testing"
+)
+
+func TestSplitArch(t *testing.T) {
+	for arch, expected := range map[string][2]string{
+		"windows/amd64": {"windows", "amd64"},
+		"linux/arm64":   {"linux", "arm64"},
+		"windows":       {"windows", ""},
+	} {
+		goos, goarch := splitArch(arch)
+
+		if goos != expected[0] || goarch != expected[1] {
+			t.Errorf("%v: expected %v, got %v %v", arch, expected, goos, goarch)
+		}
+	}
+}